@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+
+	libvirt "libvirt.org/libvirt-go"
+)
+
+type AdoptOptions struct {
+	Name   string
+	IP     net.IP
+	Groups []string
+}
+
+// Start managing a domain that was not created by lab-cli
+func adoptCommand(args []string, config *Config) error {
+	// Parse arguments
+	options, err := parseAdopt(args)
+	if err != nil {
+		return err
+	}
+
+	// Create a libvirt connection
+	conn, err := libvirt.NewConnect("qemu:///system")
+	if err != nil {
+		return err
+	}
+
+	domain, err := getExistingDomain(conn, options.Name)
+	if err != nil {
+		return err
+	}
+
+	desc, err := getDomainDesc(domain)
+	if err != nil {
+		return err
+	}
+
+	if strings.HasPrefix(desc, "labcli:") {
+		return fmt.Errorf("'%s' is already managed by lab-cli", options.Name)
+	}
+
+	// Addresses outside the range could be given to a VM that lab-cli creates later
+	if !inRange(options.IP, config.Network.RangeStart, config.Network.RangeEnd) {
+		return fmt.Errorf("%s is not in the range %s - %s", options.IP, config.Network.RangeStart, config.Network.RangeEnd)
+	}
+
+	if err := checkAddressUnused(conn, options.Name, options.IP); err != nil {
+		return err
+	}
+
+	networks, err := getDomainNetworks(domain)
+	if err != nil {
+		return err
+	}
+
+	if !isOneOf(config.Network.Name, networks) {
+		fmt.Printf("Warning: '%s' is not connected to the network '%s', lab-cli might not be able to reach it\n", options.Name, config.Network.Name)
+	}
+
+	// The metadata goes first, the description is what makes it a lab-cli VM
+	err = setDomainMetadata(domain, &DomainMetadata{OriginalDescription: desc})
+	if err != nil {
+		return err
+	}
+
+	err = setDomainDescription(domain, options.IP, options.Groups)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("'%s' is now managed by lab-cli with the address %s\n", options.Name, options.IP)
+
+	return nil
+}
+
+// Stop managing a VM without removing it
+func forgetCommand(args []string) error {
+	// Parse arguments
+	options, err := parseGeneral(args, "forget")
+	if err != nil {
+		return err
+	}
+
+	// Create a libvirt connection
+	conn, err := libvirt.NewConnect("qemu:///system")
+	if err != nil {
+		return err
+	}
+
+	domain, err := getExistingDomain(conn, options.Name)
+	if err != nil {
+		return err
+	}
+
+	desc, err := getDomainDesc(domain)
+	if err != nil {
+		return err
+	}
+
+	if !strings.HasPrefix(desc, "labcli:") {
+		return fmt.Errorf("'%s' is not managed by lab-cli", options.Name)
+	}
+
+	// Broken metadata is removed as well, there is just no description to restore
+	metadata, _, err := readDomainMetadata(domain)
+	if err != nil {
+		return err
+	}
+
+	err = removeDomainMetadata(domain, metadata.OriginalDescription)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("'%s' is no longer managed by lab-cli. The VM and its disks are left as they are, the passwords are still shown by 'lab-cli secret show %s'.\n", options.Name, options.Name)
+
+	return nil
+}
+
+// The names of the networks the domain has interfaces on
+func getDomainNetworks(domain *libvirt.Domain) ([]string, error) {
+	type DomainXML struct {
+		Interfaces []struct {
+			Source struct {
+				Network string `xml:"network,attr"`
+			} `xml:"source"`
+		} `xml:"devices>interface"`
+	}
+
+	xmlDesc, err := domain.GetXMLDesc(0)
+	if err != nil {
+		return nil, err
+	}
+
+	var parsedDomain DomainXML
+	if err := xml.Unmarshal([]byte(xmlDesc), &parsedDomain); err != nil {
+		return nil, err
+	}
+
+	var networks []string
+	for _, iface := range parsedDomain.Interfaces {
+		if iface.Source.Network != "" {
+			networks = append(networks, iface.Source.Network)
+		}
+	}
+
+	return networks, nil
+}
+
+func parseAdopt(args []string) (*AdoptOptions, error) {
+	command := flag.NewFlagSet("adopt", flag.ExitOnError)
+	ip := command.String("ip", "", "the address the VM has in the lab network")
+	groups := command.String("groups", "", "Ansible groups for the VM, separated with commas")
+
+	command.Parse(args[2:])
+
+	if len(command.Args()) < 1 {
+		return nil, errors.New("adopt subcommand requires a name")
+	}
+
+	// Flags after the name are not parsed, they would be ignored without a word
+	if len(command.Args()) > 1 {
+		return nil, fmt.Errorf("adopt subcommand takes one name, the flags go before it: %s", strings.Join(command.Args()[1:], " "))
+	}
+
+	if *ip == "" {
+		return nil, errors.New("adopt subcommand requires --ip")
+	}
+
+	address := net.ParseIP(*ip).To4()
+	if address == nil {
+		return nil, fmt.Errorf("'%s' is not an IPv4 address", *ip)
+	}
+
+	groupList, err := parseGroups(*groups)
+	if err != nil {
+		return nil, err
+	}
+
+	options := &AdoptOptions{
+		Name:   command.Args()[0],
+		IP:     address,
+		Groups: groupList,
+	}
+
+	return options, nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestParseAdopt(t *testing.T) {
+	var tests = []struct {
+		args  []string
+		want  *AdoptOptions
+		valid bool
+	}{
+		{
+			[]string{"lab-cli", "adopt", "--ip", "192.168.100.20", "--groups", "web", "legacy01"},
+			&AdoptOptions{Name: "legacy01", IP: net.ParseIP("192.168.100.20").To4(), Groups: []string{"web"}},
+			true,
+		},
+		{
+			[]string{"lab-cli", "adopt", "--ip", "192.168.100.20", "legacy01"},
+			&AdoptOptions{Name: "legacy01", IP: net.ParseIP("192.168.100.20").To4()},
+			true,
+		},
+		{[]string{"lab-cli", "adopt", "legacy01"}, nil, false},
+		{[]string{"lab-cli", "adopt", "--ip", "fe80::1", "legacy01"}, nil, false},
+		{[]string{"lab-cli", "adopt", "--ip", "192.168.100.20", "--groups", "a:b", "legacy01"}, nil, false},
+		{[]string{"lab-cli", "adopt", "--ip", "192.168.100.20"}, nil, false},
+		{[]string{"lab-cli", "adopt", "--ip", "192.168.100.20", "legacy01", "--groups", "web"}, nil, false},
+	}
+
+	for _, test := range tests {
+		options, err := parseAdopt(test.args)
+		if (err == nil) != test.valid {
+			t.Errorf("unexpected result for %v: %v", test.args, err)
+			continue
+		}
+
+		if test.valid && !reflect.DeepEqual(options, test.want) {
+			t.Errorf("got %+v for %v, want %+v", options, test.args, test.want)
+		}
+	}
+}
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	libvirt "libvirt.org/libvirt-go"
+)
+
+type CloneOptions struct {
+	Source string
+	Name   string
+	Linked bool
+	// Replace the groups of the source if not nil
+	Groups []string
+	// Added to the variables of the source
+	Vars map[string]string
+	// The next free address is used if it is nil
+	Address net.IP
+}
+
+// What tells a VM apart from its clones on the network
+type guestIdentity struct {
+	Name    string
+	Address net.IP
+	MAC     string
+}
+
+// The name of a clone becomes its host name
+var hostnamePattern = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+// Files and directories in the guest that can contain the host name, address or MAC address
+var identityFiles = []string{
+	"/etc/hosts",
+	// Debian
+	"/etc/network/interfaces",
+	"/etc/network/interfaces.d",
+	// CentOS
+	"/etc/sysconfig/network-scripts",
+	"/etc/NetworkManager/system-connections",
+	// Ubuntu
+	"/etc/netplan",
+}
+
+// New SSH host keys and machine ID, so the clone is not mistaken for the source. The
+// edited files have no SELinux labels, so SELinux guests relabel on the first boot.
+const resetIdentityScript = `rm -f /etc/ssh/ssh_host_*
+ssh-keygen -A
+: > /etc/machine-id
+if [ -f /etc/selinux/config ]; then touch /.autorelabel; fi
+`
+
+// Create a new VM with a copy of the disks of another one. The clone gets the next free
+// address, a new MAC address and its own name, which are written into the guest before
+// it is started the first time. Groups and variables are copied from the source.
+func cloneCommand(args []string, config *Config) error {
+	// Parse arguments
+	options, err := parseClone(args)
+	if err != nil {
+		return err
+	}
+
+	// Both are needed after the disks have been copied, find out now if they are missing
+	if err := checkExecutable(config.VirtClonePath); err != nil {
+		return fmt.Errorf("virt-clone can't be run: %s. Install virt-install or change virt_clone_path in the config", err)
+	}
+
+	if err := checkExecutable(config.VirtCustomizePath); err != nil {
+		return fmt.Errorf("virt-customize can't be run: %s. Install libguestfs-tools (or guestfs-tools) or change virt_customize_path in the config", err)
+	}
+
+	// Create a libvirt connection
+	conn, err := libvirt.NewConnect("qemu:///system")
+	if err != nil {
+		return err
+	}
+
+	source, err := getExistingDomain(conn, options.Source)
+	if err != nil {
+		return err
+	}
+
+	desc, err := getDomainDesc(source)
+	if err != nil {
+		return err
+	}
+
+	if !strings.HasPrefix(desc, "labcli:") {
+		return fmt.Errorf("'%s' is not managed by lab-cli", options.Source)
+	}
+
+	summary, err := getDomainSummary(source)
+	if err != nil {
+		return err
+	}
+
+	if err := summary.Err(); err != nil {
+		return err
+	}
+
+	// A copy of disks that are written to is not consistent
+	if summary.Status {
+		return fmt.Errorf("'%s' is running, stop it before it is cloned", options.Source)
+	}
+
+	domain, err := getDomain(conn, options.Name)
+	if domain != nil {
+		return fmt.Errorf("'%s' already exists", options.Name)
+	}
+
+	if err != nil && !strings.Contains(err.Error(), "Domain not found") {
+		return err
+	}
+
+	metadata, err := getDomainMetadata(source)
+	if err != nil {
+		return err
+	}
+
+	disks, err := getDomainDisks(source)
+	if err != nil {
+		return err
+	}
+
+	if len(disks) == 0 {
+		return fmt.Errorf("'%s' has no disks to clone", options.Source)
+	}
+
+	macs, err := getDomainMACs(source)
+	if err != nil {
+		return err
+	}
+
+	from := guestIdentity{Name: options.Source, Address: summary.Address}
+	if len(macs) > 0 {
+		from.MAC = macs[0]
+	}
+
+	to := guestIdentity{Name: options.Name}
+
+	to.Address = options.Address
+	if to.Address != nil {
+		if err := checkAddressUnused(conn, options.Name, to.Address); err != nil {
+			return err
+		}
+	} else {
+		to.Address, err = nextAvailableAddress(conn, config)
+		if err != nil {
+			return err
+		}
+	}
+
+	to.MAC, err = randomMAC()
+	if err != nil {
+		return err
+	}
+
+	// Everything that is created from here on is removed again if clone fails or is interrupted
+	tx := newRollback("clone")
+	defer tx.Close()
+
+	var files []string
+
+	for i, disk := range disks {
+		fmt.Printf("Cloning the disk %s\n", disk.Source.File)
+
+		file, err := cloneVolume(conn, disk, cloneVolumeName(options.Name, i, disk, options.Linked), options.Linked)
+		if err != nil {
+			return tx.Fail(err)
+		}
+
+		tx.Add(fmt.Sprintf("delete the volume %s", file), func() error {
+			return undoVolumes(conn, []string{file})
+		})
+
+		files = append(files, file)
+
+		if tx.Interrupted() {
+			return tx.Fail(errors.New("clone was interrupted"))
+		}
+	}
+
+	// virt-clone gives the domain a new UUID and NVRAM, the disks are used as they are
+	arguments := []string{
+		"--connect", "qemu:///system",
+		"--original", options.Source,
+		"--name", options.Name,
+		"--mac", to.MAC,
+		"--preserve-data",
+	}
+
+	for _, file := range files {
+		arguments = append(arguments, "--file", file)
+	}
+
+	// The domain reserves the address in its description until it is removed
+	tx.Add(fmt.Sprintf("remove the VM '%s' and release %s", options.Name, to.Address), func() error {
+		return undoDomain(conn, options.Name)
+	})
+
+	output, err := tx.Run(exec.Command(config.VirtClonePath, arguments...))
+	if err == errInterrupted {
+		return tx.Fail(errors.New("clone was interrupted"))
+	}
+
+	if err != nil {
+		return tx.Fail(fmt.Errorf("virt-clone failed: %s\n%s", err, output))
+	}
+
+	domain, err = getDomain(conn, options.Name)
+	if err != nil {
+		return tx.Fail(err)
+	}
+
+	// virt-clone copies the description, so the clone has the address of the source until now
+	groups := summary.Groups
+	if options.Groups != nil {
+		groups = options.Groups
+	}
+
+	if err := setDomainDescription(domain, to.Address, groups); err != nil {
+		return tx.Fail(err)
+	}
+
+	if err := setDomainMetadata(domain, cloneMetadata(metadata, options, time.Now())); err != nil {
+		return tx.Fail(err)
+	}
+
+	fmt.Printf("Changing the host name to %s and the address to %s\n", to.Name, to.Address)
+
+	customize := exec.Command(config.VirtCustomizePath,
+		"--connect", "qemu:///system",
+		"--domain", options.Name,
+		"--no-network",
+		"--run-command", renameScript(from, to, config.Network.Domain, "")+resetIdentityScript,
+	)
+
+	// Without root the disks can only be opened by an appliance that the system libvirtd starts
+	customize.Env = os.Environ()
+	if os.Getenv("LIBGUESTFS_BACKEND") == "" {
+		customize.Env = append(customize.Env, "LIBGUESTFS_BACKEND=libvirt:qemu:///system")
+	}
+
+	output, err = tx.Run(customize)
+	if err == errInterrupted {
+		return tx.Fail(errors.New("clone was interrupted"))
+	}
+
+	if err != nil {
+		return tx.Fail(fmt.Errorf("virt-customize failed: %s\n%s", err, output))
+	}
+
+	// The clone has the same passwords as the source
+	secrets, err := loadSecrets()
+	if err != nil {
+		return tx.Fail(err)
+	}
+
+	if secret, exists := secrets[options.Source]; exists {
+		if err := storeSecrets(options.Name, &secret); err != nil {
+			return tx.Fail(err)
+		}
+
+		tx.Add(fmt.Sprintf("remove the passwords of '%s'", options.Name), func() error {
+			return storeSecrets(options.Name, nil)
+		})
+	}
+
+	// A VM that used the address before had other host keys
+	knownHosts, err := getKnownHostsFile()
+	if err != nil {
+		return tx.Fail(err)
+	}
+
+	if _, err := os.Stat(knownHosts); err == nil {
+		if err := removeKnownHost(knownHosts, to.Address.String()); err != nil {
+			return tx.Fail(err)
+		}
+	}
+
+	if tx.Interrupted() {
+		return tx.Fail(errors.New("clone was interrupted"))
+	}
+
+	tx.Commit()
+
+	fmt.Printf("'%s' has been cloned from '%s' and has the address %s. Start it with 'lab-cli start %s'.\n", options.Name, options.Source, to.Address, options.Name)
+
+	if options.Linked {
+		fmt.Printf("The disks of '%s' are now the base of '%s', it can't be started until the clone is removed.\n", options.Source, options.Name)
+	}
+
+	return nil
+}
+
+// Create a volume in the same pool as the disk, with a copy of its content or as an
+// overlay on it. Returns the path of the new volume.
+func cloneVolume(conn *libvirt.Connect, disk DomainDisk, name string, linked bool) (string, error) {
+	source, err := conn.LookupStorageVolByPath(disk.Source.File)
+	if err != nil {
+		if strings.Contains(err.Error(), "Storage volume not found") {
+			return "", fmt.Errorf("the disk %s is not a volume in a storage pool and can't be cloned", disk.Source.File)
+		}
+
+		return "", err
+	}
+	defer source.Free()
+
+	pool, err := source.LookupPoolByVolume()
+	if err != nil {
+		return "", err
+	}
+	defer pool.Free()
+
+	info, err := source.GetInfo()
+	if err != nil {
+		return "", err
+	}
+
+	xmlData, err := xml.Marshal(cloneVolumeXML(name, info.Capacity, disk, linked))
+	if err != nil {
+		return "", err
+	}
+
+	var volume *libvirt.StorageVol
+	if linked {
+		volume, err = pool.StorageVolCreateXML(string(xmlData), 0)
+	} else {
+		volume, err = pool.StorageVolCreateXMLFrom(string(xmlData), source, 0)
+	}
+
+	if err != nil {
+		return "", err
+	}
+	defer volume.Free()
+
+	return volume.GetPath()
+}
+
+// A linked clone is a qcow2 overlay on the disk, otherwise the copy has the format of the disk
+func cloneVolumeXML(name string, capacity uint64, disk DomainDisk, linked bool) VolumeXML {
+	format := disk.Driver.Type
+	if format == "" {
+		format = "raw"
+	}
+
+	data := VolumeXML{Name: name}
+	data.Capacity.Unit = "bytes"
+	data.Capacity.Value = int64(capacity)
+	data.Target.Format.Type = format
+
+	if linked {
+		data.Target.Format.Type = "qcow2"
+		data.BackingStore = &VolumeBackingStore{Path: disk.Source.File}
+		data.BackingStore.Format.Type = format
+	}
+
+	return data
+}
+
+// Volume names like the ones create gives the system disk and extra disks. The extra
+// disks are named after their serial number, which the clone keeps.
+func cloneVolumeName(name string, index int, disk DomainDisk, linked bool) string {
+	extension := path.Ext(disk.Source.File)
+	if linked {
+		extension = ".qcow2"
+	}
+
+	if index == 0 {
+		return name + extension
+	}
+
+	serial := disk.Serial
+	if serial == "" {
+		serial = fmt.Sprintf("disk%d", index)
+	}
+
+	return fmt.Sprintf("%s-%s%s", name, serial, extension)
+}
+
+// The metadata of the source for the clone, with the variables from the options
+func cloneMetadata(metadata *DomainMetadata, options *CloneOptions, now time.Time) *DomainMetadata {
+	clone := *metadata
+	clone.CreatedAt = &now
+
+	// Only the source had a description before it was adopted
+	clone.OriginalDescription = ""
+
+	vars := varsMap(metadata.Vars)
+	for name, value := range options.Vars {
+		vars[name] = value
+	}
+
+	clone.Vars = sortedVars(vars)
+
+	if options.Linked {
+		clone.DiskFormat = "qcow2"
+	}
+
+	return &clone
+}
+
+// Shell commands that write the host name of the clone and replace the address, MAC
+// address and name of the source in the network configuration of the guest. The
+// files are relative to root, which is only set by the tests.
+func renameScript(from guestIdentity, to guestIdentity, domain string, root string) string {
+	var files []string
+	for _, file := range identityFiles {
+		files = append(files, root+file)
+	}
+
+	hostnameFile := root + "/etc/hostname"
+
+	// Only whole addresses and names are replaced, 192.168.100.1 is not a part of
+	// 192.168.100.12. The loops find matches right after each other as well.
+	patterns := []string{"-e", from.Address.String()}
+	expressions := []string{
+		"-e", ":address",
+		"-e", fmt.Sprintf(`s/(^|[^0-9.])%s([^0-9.]|$)/\1%s\2/`, strings.ReplaceAll(from.Address.String(), ".", `\.`), to.Address),
+		"-e", "taddress",
+	}
+
+	if from.MAC != "" {
+		patterns = append(patterns, "-e", from.MAC)
+		expressions = append(expressions, "-e", fmt.Sprintf("s/%s/%s/gI", from.MAC, to.MAC))
+	}
+
+	// A VM with a name that is not a host name has some other host name in the guest
+	if hostnamePattern.MatchString(from.Name) {
+		patterns = append(patterns, "-e", from.Name)
+		expressions = append(expressions,
+			"-e", ":name",
+			"-e", fmt.Sprintf(`s/(^|[^a-zA-Z0-9-])%s([^a-zA-Z0-9-]|$)/\1%s\2/`, from.Name, to.Name),
+			"-e", "tname",
+		)
+	}
+
+	lines := []string{
+		"set -e",
+		// Kickstart puts the FQDN in /etc/hostname, the others only the name
+		"hostname=" + shellJoin([]string{to.Name}),
+		fmt.Sprintf(`if grep -q '\.' %s 2>/dev/null; then hostname=%s; fi`, hostnameFile, shellJoin([]string{to.Name + "." + domain})),
+		fmt.Sprintf(`echo "$hostname" > %s`, hostnameFile),
+		fmt.Sprintf("grep -rlsiFZ %s %s | xargs -0 -r sed -E -i %s", shellJoin(patterns), shellJoin(files), shellJoin(expressions)),
+	}
+
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// A VM whose disks are the base of linked clones must not be started, the clones
+// see everything it writes to the disks as corruption
+func checkNoLinkedClones(conn *libvirt.Connect, domain *libvirt.Domain, name string) error {
+	used, err := getUsedDiskFiles(conn)
+	if err != nil {
+		return err
+	}
+
+	disks, err := getDomainDisks(domain)
+	if err != nil {
+		return err
+	}
+
+	for _, disk := range disks {
+		if used[disk.Source.File] > 1 {
+			return fmt.Errorf("'%s' can't be started since another VM is built on its disk %s, like a linked clone. Remove that VM first", name, disk.Source.File)
+		}
+	}
+
+	return nil
+}
+
+func parseClone(args []string) (*CloneOptions, error) {
+	vars := VarFlag{}
+
+	command := flag.NewFlagSet("clone", flag.ExitOnError)
+	linked := command.Bool("linked", false, "create the disks as qcow2 overlays on the disks of the source instead of copying them")
+	groups := command.String("groups", "", "the Ansible groups of the clone, separated with commas (default from the source)")
+	command.Var(&vars, "var", "Ansible host variable as key=value, replaces the one from the source, can be repeated")
+	ip := command.String("ip", "", "address of the clone in the lab network (default the next free one)")
+
+	command.Parse(args[2:])
+
+	if len(command.Args()) < 2 {
+		return nil, errors.New("clone subcommand requires the name of a VM and a name for the clone")
+	}
+
+	options := &CloneOptions{
+		Source: command.Args()[0],
+		Name:   command.Args()[1],
+		Linked: *linked,
+		Vars:   vars,
+	}
+
+	if !hostnamePattern.MatchString(options.Name) {
+		return nil, fmt.Errorf("'%s' can't be used as a host name, use letters, digits and -", options.Name)
+	}
+
+	if *ip != "" {
+		options.Address = net.ParseIP(*ip).To4()
+		if options.Address == nil {
+			return nil, fmt.Errorf("'%s' is not an IPv4 address", *ip)
+		}
+	}
+
+	var err error
+
+	options.Groups, err = parseGroups(*groups)
+	if err != nil {
+		return nil, err
+	}
+
+	return options, nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/xml"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRenameScript(t *testing.T) {
+	root := t.TempDir()
+
+	files := map[string]string{
+		"/etc/hostname":           "web01\n",
+		"/etc/hosts":              "127.0.0.1\tlocalhost\n192.168.100.12\tweb01.lab.local web01\n192.168.100.1\tgateway web01-db\n",
+		"/etc/network/interfaces": "iface enp1s0 inet static\n\taddress 192.168.100.12/24\n\tgateway 192.168.100.1\n",
+		"/etc/sysconfig/network-scripts/ifcfg-enp1s0":                 "HWADDR=52:54:00:AA:BB:CC\nIPADDR=192.168.100.12\nGATEWAY=192.168.100.1\n",
+		"/etc/NetworkManager/system-connections/Wired 1.nmconnection": "[ipv4]\naddress1=192.168.100.12/24,192.168.100.1\n",
+		"/etc/netplan/00-installer-config.yaml":                       "addresses:\n- 192.168.100.120/24\n- 192.168.100.12/24\n",
+	}
+
+	want := map[string]string{
+		"/etc/hostname":           "web02\n",
+		"/etc/hosts":              "127.0.0.1\tlocalhost\n192.168.100.40\tweb02.lab.local web02\n192.168.100.1\tgateway web01-db\n",
+		"/etc/network/interfaces": "iface enp1s0 inet static\n\taddress 192.168.100.40/24\n\tgateway 192.168.100.1\n",
+		"/etc/sysconfig/network-scripts/ifcfg-enp1s0":                 "HWADDR=52:54:00:11:22:33\nIPADDR=192.168.100.40\nGATEWAY=192.168.100.1\n",
+		"/etc/NetworkManager/system-connections/Wired 1.nmconnection": "[ipv4]\naddress1=192.168.100.40/24,192.168.100.1\n",
+		"/etc/netplan/00-installer-config.yaml":                       "addresses:\n- 192.168.100.120/24\n- 192.168.100.40/24\n",
+	}
+
+	for file, content := range files {
+		if err := os.MkdirAll(path.Dir(root+file), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(root+file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	from := guestIdentity{Name: "web01", Address: net.ParseIP("192.168.100.12"), MAC: "52:54:00:aa:bb:cc"}
+	to := guestIdentity{Name: "web02", Address: net.ParseIP("192.168.100.40"), MAC: "52:54:00:11:22:33"}
+
+	output, err := exec.Command("sh", "-c", renameScript(from, to, "lab.local", root)).CombinedOutput()
+	if err != nil {
+		t.Fatalf("the script failed: %s\n%s", err, output)
+	}
+
+	for file, content := range want {
+		data, err := os.ReadFile(root + file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(data) != content {
+			t.Errorf("got %q in %s, want %q", data, file, content)
+		}
+	}
+
+	// The installer put the FQDN in /etc/hostname
+	if err := os.WriteFile(root+"/etc/hostname", []byte("web02.lab.local\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	to = guestIdentity{Name: "web03", Address: net.ParseIP("192.168.100.41"), MAC: "52:54:00:11:22:34"}
+
+	output, err = exec.Command("sh", "-c", renameScript(from, to, "lab.local", root)).CombinedOutput()
+	if err != nil {
+		t.Fatalf("the script failed: %s\n%s", err, output)
+	}
+
+	if data, _ := os.ReadFile(root + "/etc/hostname"); string(data) != "web03.lab.local\n" {
+		t.Errorf("got %q in /etc/hostname, want the FQDN", data)
+	}
+}
+
+func TestCloneVolumeName(t *testing.T) {
+	var system, data DomainDisk
+	system.Source.File = "/var/lib/libvirt/images/web01.qcow2"
+	data.Source.File = "/var/lib/libvirt/images/web01-data.img"
+	data.Serial = "data"
+
+	var tests = []struct {
+		index  int
+		disk   DomainDisk
+		linked bool
+		want   string
+	}{
+		{0, system, false, "web02.qcow2"},
+		{1, data, false, "web02-data.img"},
+		{1, data, true, "web02-data.qcow2"},
+		{2, system, false, "web02-disk2.qcow2"},
+	}
+
+	for _, test := range tests {
+		if got := cloneVolumeName("web02", test.index, test.disk, test.linked); got != test.want {
+			t.Errorf("got %s for disk %d (linked: %t), want %s", got, test.index, test.linked, test.want)
+		}
+	}
+}
+
+func TestCloneVolumeXML(t *testing.T) {
+	var disk DomainDisk
+	disk.Source.File = "/var/lib/libvirt/images/web01.img"
+	disk.Driver.Type = "raw"
+
+	data, err := xml.Marshal(cloneVolumeXML("web02.qcow2", 10737418240, disk, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `<volume><name>web02.qcow2</name><capacity unit="bytes">10737418240</capacity><target><format type="qcow2"></format></target>` +
+		`<backingStore><path>/var/lib/libvirt/images/web01.img</path><format type="raw"></format></backingStore></volume>`
+	if string(data) != want {
+		t.Errorf("got %s, want %s", data, want)
+	}
+
+	data, err = xml.Marshal(cloneVolumeXML("web02.img", 10737418240, disk, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want = `<volume><name>web02.img</name><capacity unit="bytes">10737418240</capacity><target><format type="raw"></format></target></volume>`
+	if string(data) != want {
+		t.Errorf("got %s, want %s", data, want)
+	}
+}
+
+func TestCloneMetadata(t *testing.T) {
+	created := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	now := created.Add(time.Hour)
+
+	metadata := &DomainMetadata{
+		Distro:              "debian",
+		CreatedAt:           &created,
+		Vars:                []DomainVar{{Name: "role", Value: "web"}, {Name: "tier", Value: "prod"}},
+		DiskFormat:          "raw",
+		OriginalDescription: "handmade",
+	}
+
+	options := &CloneOptions{Source: "web01", Name: "web02", Linked: true, Vars: map[string]string{"tier": "test"}}
+
+	want := &DomainMetadata{
+		Distro:     "debian",
+		CreatedAt:  &now,
+		Vars:       []DomainVar{{Name: "role", Value: "web"}, {Name: "tier", Value: "test"}},
+		DiskFormat: "qcow2",
+	}
+
+	if got := cloneMetadata(metadata, options, now); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	if metadata.Vars[1].Value != "prod" || metadata.CreatedAt != &created {
+		t.Error("the metadata of the source was changed")
+	}
+}
+
+func TestParseClone(t *testing.T) {
+	var tests = []struct {
+		args  []string
+		want  *CloneOptions
+		valid bool
+	}{
+		{
+			[]string{"lab-cli", "clone", "web01", "web02"},
+			&CloneOptions{Source: "web01", Name: "web02", Vars: map[string]string{}},
+			true,
+		},
+		{
+			[]string{"lab-cli", "clone", "--linked", "--groups", "test,web", "--var", "tier=test", "web01", "web02"},
+			&CloneOptions{Source: "web01", Name: "web02", Linked: true, Groups: []string{"test", "web"}, Vars: map[string]string{"tier": "test"}},
+			true,
+		},
+		{
+			[]string{"lab-cli", "clone", "--ip", "192.168.100.40", "web01", "web02"},
+			&CloneOptions{Source: "web01", Name: "web02", Vars: map[string]string{}, Address: net.ParseIP("192.168.100.40").To4()},
+			true,
+		},
+		{[]string{"lab-cli", "clone", "--ip", "web", "web01", "web02"}, nil, false},
+		{[]string{"lab-cli", "clone", "web01"}, nil, false},
+		{[]string{"lab-cli", "clone", "web01", "web_02"}, nil, false},
+		{[]string{"lab-cli", "clone", "--groups", "a:b", "web01", "web02"}, nil, false},
+	}
+
+	for _, test := range tests {
+		options, err := parseClone(test.args)
+		if (err == nil) != test.valid {
+			t.Errorf("unexpected result for %v: %v", test.args, err)
+			continue
+		}
+
+		if test.valid && !reflect.DeepEqual(options, test.want) {
+			t.Errorf("got %+v for %v, want %+v", options, test.args, test.want)
+		}
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path"
+	"strings"
+	"text/template"
+
+	"github.com/BurntSushi/toml"
+	"golang.org/x/crypto/ssh"
+)
+
+// The example configuration and templates from the repository are built into the
+// binary. They are used when the user has not created their own.
+//
+//go:embed config/config.toml config/templates
+var defaultFiles embed.FS
+
+type ConfigInitOptions struct {
+	Force bool
+}
+
+func configCommand(args []string, config *Config) error {
+	if len(args) < 3 {
+		return errors.New("config subcommand requires an action (init, show, check)")
+	}
+
+	switch args[2] {
+	case "init":
+		return configInitCommand(args)
+	case "show":
+		return configShowCommand(config)
+	case "check":
+		return configCheckCommand(config)
+	}
+
+	return fmt.Errorf("'%s' is not a valid config action", args[2])
+}
+
+// Write the default configuration and templates into the config directory
+func configInitCommand(args []string) error {
+	options, err := parseConfigInit(args)
+	if err != nil {
+		return err
+	}
+
+	configDir, err := getConfigDir()
+	if err != nil {
+		return err
+	}
+
+	err = fs.WalkDir(defaultFiles, "config", func(file string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		outFile := path.Join(configDir, file[len("config"):])
+
+		if entry.IsDir() {
+			return os.MkdirAll(outFile, 0755)
+		}
+
+		// Don't touch files that the user might have changed
+		if _, err := os.Stat(outFile); err == nil && !options.Force {
+			fmt.Printf("%s already exists, skipping\n", outFile)
+			return nil
+		}
+
+		data, err := defaultFiles.ReadFile(file)
+		if err != nil {
+			return err
+		}
+
+		if err := os.WriteFile(outFile, data, 0644); err != nil {
+			return err
+		}
+
+		fmt.Printf("Created %s\n", outFile)
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Print the configuration that is actually used, after the config file has been merged with the defaults
+func configShowCommand(config *Config) error {
+	configDir, err := getConfigDir()
+	if err != nil {
+		return err
+	}
+
+	configFile := path.Join(configDir, "config.toml")
+
+	if _, err := os.Stat(configFile); os.IsNotExist(err) {
+		fmt.Printf("# %s does not exist, using the default configuration\n", configFile)
+	} else {
+		fmt.Printf("# Loaded from %s\n", configFile)
+	}
+
+	return toml.NewEncoder(os.Stdout).Encode(redactConfig(config))
+}
+
+// Shown instead of a secret in the configuration
+const redacted = "<redacted>"
+
+// A copy of the configuration without the root password and the password of the proxy,
+// so it can be shown or pasted somewhere
+func redactConfig(config *Config) *Config {
+	copied := *config
+
+	if copied.RootPassword != "" {
+		copied.RootPassword = redacted
+	}
+
+	if proxy, err := url.Parse(copied.Install.HTTPProxy); err == nil && proxy.User != nil {
+		if _, exists := proxy.User.Password(); exists {
+			proxy.User = url.UserPassword(proxy.User.Username(), redacted)
+			copied.Install.HTTPProxy = proxy.String()
+		}
+	}
+
+	return &copied
+}
+
+func configCheckCommand(config *Config) error {
+	if problems := validateConfig(config); len(problems) > 0 {
+		return configProblemsError(problems)
+	}
+
+	fmt.Println("The configuration looks good")
+
+	return nil
+}
+
+// Check the configuration for everything that would make create fail or create
+// a broken VM. All problems are returned so they can be fixed at once.
+func validateConfig(config *Config) []error {
+	var problems []error
+
+	if config.StoragePool == "" {
+		problems = append(problems, errors.New("storage_pool is empty"))
+	}
+
+	network := config.Network
+
+	if network.Name == "" {
+		problems = append(problems, errors.New("network.name is empty"))
+	}
+
+	if network.Domain == "" {
+		problems = append(problems, errors.New("network.domain is empty"))
+	}
+
+	// Limited by the kernel (IFNAMSIZ)
+	if network.BridgeName == "" {
+		problems = append(problems, errors.New("network.bridge_name is empty"))
+	} else if len(network.BridgeName) > 15 {
+		problems = append(problems, fmt.Errorf("network.bridge_name '%s' is longer than 15 characters", network.BridgeName))
+	}
+
+	addresses := []struct {
+		name    string
+		address net.IP
+	}{
+		{"network.address", network.Address},
+		{"network.netmask", network.Netmask},
+		{"network.range_start", network.RangeStart},
+		{"network.range_end", network.RangeEnd},
+	}
+
+	validAddresses := true
+
+	for _, a := range addresses {
+		if a.address.To4() == nil {
+			problems = append(problems, fmt.Errorf("%s is not a valid IPv4 address", a.name))
+			validAddresses = false
+		}
+	}
+
+	if validAddresses {
+		problems = append(problems, validateNetworkRange(network)...)
+	}
+
+	for _, nameserver := range config.Install.Nameservers {
+		if net.ParseIP(nameserver) == nil {
+			problems = append(problems, fmt.Errorf("install.nameservers: '%s' is not a valid IP address", nameserver))
+		}
+	}
+
+	// An empty or broken key gives us a VM that nobody can log in to
+	if config.AnsiblePublicKey == "" && config.AnsiblePublicKeyFile != "" {
+		problems = append(problems, fmt.Errorf("ansible_public_key_file %s does not exist or is empty, 'lab-cli keygen' creates a key pair", config.AnsiblePublicKeyFile))
+	} else if config.AnsiblePublicKey == "" {
+		problems = append(problems, errors.New("ansible_public_key is empty, nobody would be able to log in to the VMs"))
+	} else if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(config.AnsiblePublicKey)); err != nil {
+		problems = append(problems, fmt.Errorf("ansible_public_key is not a valid public key: %s", err))
+	}
+
+	for _, distro := range distros {
+		// A local path is fine too, like an ISO image
+		distroConfig := getDistroConfig(config, distro)
+
+		location, err := url.Parse(distroConfig.Location)
+		if !path.IsAbs(distroConfig.Location) && (err != nil || location.Host == "" || (location.Scheme != "http" && location.Scheme != "https" && location.Scheme != "ftp")) {
+			problems = append(problems, fmt.Errorf("%s.location '%s' is not a valid URL or absolute path", distro, distroConfig.Location))
+		}
+
+		// Render the template with example values to find errors in it
+		options := &CreateOptions{Name: "check", Distro: distro}
+		secrets := &Secrets{RootPassword: "check", AnsiblePassword: "check"}
+
+		if err := executeTemplate(ioutil.Discard, config, options, network.RangeStart, secrets); err != nil {
+			problems = append(problems, fmt.Errorf("template for %s: %s", distro, err))
+		}
+	}
+
+	return problems
+}
+
+// The address range has to fit inside the network, and not include the
+// network, broadcast or gateway address
+func validateNetworkRange(network NetworkConfig) []error {
+	var problems []error
+
+	mask := net.IPMask(network.Netmask.To4())
+	if ones, bits := mask.Size(); ones == 0 && bits == 0 {
+		return append(problems, fmt.Errorf("network.netmask %s is not a valid netmask", network.Netmask))
+	}
+
+	subnet := &net.IPNet{IP: network.Address.Mask(mask), Mask: mask}
+
+	broadcast := make(net.IP, 4)
+	for i := range broadcast {
+		broadcast[i] = subnet.IP[i] | ^mask[i]
+	}
+
+	if network.Address.Equal(subnet.IP) || network.Address.Equal(broadcast) {
+		problems = append(problems, fmt.Errorf("network.address %s can not be the network or broadcast address", network.Address))
+	}
+
+	for _, a := range []struct {
+		name    string
+		address net.IP
+	}{
+		{"network.range_start", network.RangeStart},
+		{"network.range_end", network.RangeEnd},
+	} {
+		if !subnet.Contains(a.address) {
+			problems = append(problems, fmt.Errorf("%s %s is outside of the network %s", a.name, a.address, subnet))
+		}
+	}
+
+	start := network.RangeStart.To4()
+	end := network.RangeEnd.To4()
+
+	if bytes.Compare(start, end) > 0 {
+		return append(problems, fmt.Errorf("network.range_start %s is after network.range_end %s", start, end))
+	}
+
+	inRange := func(ip net.IP) bool {
+		ip = ip.To4()
+		return bytes.Compare(ip, start) >= 0 && bytes.Compare(ip, end) <= 0
+	}
+
+	if inRange(subnet.IP) || inRange(broadcast) {
+		problems = append(problems, fmt.Errorf("the address range %s-%s includes the network or broadcast address", start, end))
+	}
+
+	if inRange(network.Address) {
+		problems = append(problems, fmt.Errorf("the address range %s-%s includes the gateway address %s", start, end, network.Address))
+	}
+
+	return problems
+}
+
+// One error with all problems, one per line
+func configProblemsError(problems []error) error {
+	var lines []string
+	for _, problem := range problems {
+		lines = append(lines, fmt.Sprintf("  - %s", problem))
+	}
+
+	return fmt.Errorf("found %d problem(s) in the configuration:\n%s", len(problems), strings.Join(lines, "\n"))
+}
+
+// Extra functions that can be used in the templates
+var templateFuncs = template.FuncMap{
+	"join": strings.Join,
+}
+
+// Parse a template from the template directory, or the built-in one if the user does not have it
+func parseTemplate(name string) (*template.Template, error) {
+	templateDir, err := getTemplateDir()
+	if err != nil {
+		return nil, err
+	}
+
+	templateFile := path.Join(templateDir, name)
+
+	t := template.New(name).Funcs(templateFuncs)
+
+	if _, err := os.Stat(templateFile); os.IsNotExist(err) {
+		return t.ParseFS(defaultFiles, path.Join("config", "templates", name))
+	} else if err != nil {
+		return nil, err
+	}
+
+	return t.ParseFiles(templateFile)
+}
+
+func parseConfigInit(args []string) (*ConfigInitOptions, error) {
+	command := flag.NewFlagSet("config init", flag.ExitOnError)
+	force := command.Bool("force", false, "overwrite existing files")
+
+	command.Parse(args[3:])
+
+	options := &ConfigInitOptions{
+		Force: *force,
+	}
+
+	return options, nil
+}
+
+// Expand ~ to the home directory of the current user, since that is only done by the shell
+func expandPath(file string) string {
+	if file != "~" && !strings.HasPrefix(file, "~/") {
+		return file
+	}
+
+	user, err := user.Current()
+	if err != nil {
+		return file
+	}
+
+	return path.Join(user.HomeDir, file[1:])
+}
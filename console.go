@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+	libvirt "libvirt.org/libvirt-go"
+)
+
+// Ctrl+], same escape character as virsh console
+const consoleEscape = 0x1d
+
+type ConsoleOptions struct {
+	Name  string
+	Force bool
+}
+
+func consoleCommand(args []string) error {
+	// Parse arguments
+	options, err := parseConsole(args)
+	if err != nil {
+		return err
+	}
+
+	// Create a libvirt connection
+	conn, err := libvirt.NewConnect("qemu:///system")
+	if err != nil {
+		return err
+	}
+
+	domain, err := getExistingDomain(conn, options.Name)
+	if err != nil {
+		return err
+	}
+
+	active, err := domain.IsActive()
+	if err != nil {
+		return err
+	}
+
+	if !active {
+		return fmt.Errorf("'%s' is not running", options.Name)
+	}
+
+	err = attachConsole(conn, domain, options.Name, nil, options.Force)
+	if err != nil && strings.Contains(err.Error(), "Active console session exists") {
+		return fmt.Errorf("the console of '%s' is in use, maybe by create following the installation. "+
+			"Follow it with 'lab-cli logs --follow %s' instead, or take the console over with --force", options.Name, options.Name)
+	}
+
+	return err
+}
+
+// Open a stream to the serial console of the domain. Force takes the console over from
+// anyone else that has it open, like a previous lab-cli, without it that is an error.
+func openConsole(conn *libvirt.Connect, domain *libvirt.Domain, force bool) (*libvirt.Stream, error) {
+	stream, err := conn.NewStream(0)
+	if err != nil {
+		return nil, err
+	}
+
+	var flags libvirt.DomainConsoleFlags
+	if force {
+		flags = libvirt.DOMAIN_CONSOLE_FORCE
+	}
+
+	err = domain.OpenConsole("", stream, flags)
+	if err != nil {
+		stream.Free()
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+// Connect the local terminal to the serial console of the domain until the escape
+// character is pressed or the VM stops. The output is also written to log if it is set.
+func attachConsole(conn *libvirt.Connect, domain *libvirt.Domain, name string, log io.Writer, force bool) error {
+	stream, err := openConsole(conn, domain, force)
+	if err != nil {
+		return err
+	}
+	defer stream.Free()
+
+	fmt.Printf("Connected to the console of '%s' (press Ctrl+] to exit)\n", name)
+
+	// Raw mode sends every key press directly to the VM, without it things like
+	// tab completion and Ctrl+C would not work
+	stdin := int(os.Stdin.Fd())
+
+	if term.IsTerminal(stdin) {
+		oldState, err := term.MakeRaw(stdin)
+		if err != nil {
+			return err
+		}
+		defer term.Restore(stdin, oldState)
+	}
+
+	var out io.Writer = os.Stdout
+	if log != nil {
+		out = io.MultiWriter(os.Stdout, log)
+	}
+
+	received := make(chan error, 1)
+	done := make(chan error, 1)
+
+	// VM -> terminal
+	go func() {
+		buf := make([]byte, 1024)
+
+		for {
+			n, err := stream.Recv(buf)
+			if err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+
+				received <- err
+				return
+			}
+
+			out.Write(buf[:n])
+		}
+	}()
+
+	// Terminal -> VM
+	go func() {
+		buf := make([]byte, 1024)
+
+		for {
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				done <- err
+				return
+			}
+
+			// Send what was typed before the escape character, Send can't take an empty slice
+			if i := bytes.IndexByte(buf[:n], consoleEscape); i >= 0 {
+				if i > 0 {
+					if _, err := stream.Send(buf[:i]); err != nil {
+						done <- err
+						return
+					}
+				}
+
+				done <- nil
+				return
+			}
+
+			if _, err := stream.Send(buf[:n]); err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+
+	// log is written by the reader, so it has to be finished before we return
+	select {
+	case err = <-received:
+		stream.Abort()
+	case err = <-done:
+		stream.Abort()
+		<-received
+	}
+
+	// The terminal is still in raw mode so we need a carriage return
+	fmt.Print("\r\n")
+
+	return err
+}
+
+func parseConsole(args []string) (*ConsoleOptions, error) {
+	command := flag.NewFlagSet("console", flag.ExitOnError)
+	force := command.Bool("force", false, "take the console over from anyone else that has it open, like create following an installation")
+
+	command.Parse(args[2:])
+
+	if len(command.Args()) < 1 {
+		return nil, errors.New("console subcommand requires a name")
+	}
+
+	return &ConsoleOptions{Name: command.Args()[0], Force: *force}, nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseConsole(t *testing.T) {
+	var tests = []struct {
+		args  []string
+		want  *ConsoleOptions
+		valid bool
+	}{
+		{[]string{"lab-cli", "console", "web01"}, &ConsoleOptions{Name: "web01"}, true},
+		{[]string{"lab-cli", "console", "--force", "web01"}, &ConsoleOptions{Name: "web01", Force: true}, true},
+		{[]string{"lab-cli", "console"}, nil, false},
+	}
+
+	for _, test := range tests {
+		options, err := parseConsole(test.args)
+		if (err == nil) != test.valid {
+			t.Errorf("unexpected result for %v: %v", test.args, err)
+			continue
+		}
+
+		if test.valid && !reflect.DeepEqual(options, test.want) {
+			t.Errorf("got %+v for %v, want %+v", options, test.args, test.want)
+		}
+	}
+}
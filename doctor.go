@@ -0,0 +1,212 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	libvirt "libvirt.org/libvirt-go"
+)
+
+// Result of one check, the hint is shown when the check fails
+type CheckResult struct {
+	Name string
+	Err  error
+	Hint string
+}
+
+func doctorCommand(config *Config) error {
+	var results []CheckResult
+
+	// Most checks need a working libvirt connection
+	conn, err := libvirt.NewConnect("qemu:///system")
+	results = append(results, CheckResult{
+		Name: "Connect to qemu:///system",
+		Err:  err,
+		Hint: "Make sure libvirtd is running and add your user to the libvirt group (log out and in again afterwards)",
+	})
+
+	results = append(results, checkVirtInstall(config))
+	results = append(results, checkKVM(conn)...)
+
+	if conn != nil {
+		results = append(results, checkStoragePool(conn, config))
+		results = append(results, checkNetwork(conn, config)...)
+	}
+
+	results = append(results, checkPrivateKey(config))
+
+	failed := 0
+
+	for _, result := range results {
+		if result.Err == nil {
+			fmt.Printf("[ OK ] %s\n", result.Name)
+			continue
+		}
+
+		failed++
+		fmt.Printf("[FAIL] %s: %s\n", result.Name, result.Err)
+		fmt.Printf("       %s\n", result.Hint)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("\n%d of %d checks failed", failed, len(results))
+	}
+
+	return nil
+}
+
+func checkVirtInstall(config *Config) CheckResult {
+	result := CheckResult{
+		Name: fmt.Sprintf("virt-install exists at %s", config.VirtInstallPath),
+		Hint: "Install virt-install (usually in a package called virt-install or virtinst) or change virt_install_path in the config",
+	}
+
+	result.Err = checkExecutable(config.VirtInstallPath)
+
+	return result
+}
+
+func checkExecutable(file string) error {
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() || info.Mode()&0111 == 0 {
+		return errors.New("not an executable file")
+	}
+
+	return nil
+}
+
+func checkKVM(conn *libvirt.Connect) []CheckResult {
+	result := CheckResult{
+		Name: "KVM device /dev/kvm exists",
+		Hint: "Enable virtualization (VT-x/AMD-V) in the BIOS and load the kvm_intel or kvm_amd kernel module",
+	}
+
+	info, err := os.Stat("/dev/kvm")
+	if err != nil {
+		result.Err = err
+	} else if info.Mode()&os.ModeCharDevice == 0 {
+		result.Err = errors.New("not a character device")
+	}
+
+	results := []CheckResult{result}
+
+	// libvirt is the one that opens the device, so ask it if KVM can be used
+	if conn != nil {
+		_, err := conn.GetDomainCapabilities("", "", "", "kvm", 0)
+		results = append(results, CheckResult{
+			Name: "libvirt can use KVM",
+			Err:  err,
+			Hint: "Make sure the qemu-kvm package is installed and that /dev/kvm is accessible for the user QEMU runs as",
+		})
+	}
+
+	return results
+}
+
+func checkStoragePool(conn *libvirt.Connect, config *Config) CheckResult {
+	result := CheckResult{
+		Name: fmt.Sprintf("Storage pool '%s' is active with free space", config.StoragePool),
+		Hint: fmt.Sprintf("Start the pool with 'virsh pool-start %s' and 'virsh pool-autostart %s', or free up some disk space", config.StoragePool, config.StoragePool),
+	}
+
+	pool, err := conn.LookupStoragePoolByName(config.StoragePool)
+	if err != nil {
+		result.Err = err
+		result.Hint = fmt.Sprintf("Create the pool with 'virsh pool-define-as %s dir --target /var/lib/libvirt/images' and start it", config.StoragePool)
+		return result
+	}
+
+	active, err := pool.IsActive()
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	if !active {
+		result.Err = errors.New("the pool is not active")
+		return result
+	}
+
+	info, err := pool.GetInfo()
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	// Enough for one VM with the default disk size
+	if info.Available < 10*1024*1024*1024 {
+		result.Err = fmt.Errorf("only %.1f GB available", float64(info.Available)/1024/1024/1024)
+		return result
+	}
+
+	result.Name = fmt.Sprintf("%s (%.1f GB available)", result.Name, float64(info.Available)/1024/1024/1024)
+
+	return result
+}
+
+func checkNetwork(conn *libvirt.Connect, config *Config) []CheckResult {
+	result := CheckResult{
+		Name: fmt.Sprintf("Network '%s' exists and is active", config.Network.Name),
+		Hint: "The network is created and started by 'lab-cli create', or start it with 'virsh net-start " + config.Network.Name + "'",
+	}
+
+	network, err := getNetwork(conn, config)
+	if err != nil {
+		result.Err = err
+		return []CheckResult{result}
+	}
+
+	active, err := network.IsActive()
+	if err != nil {
+		result.Err = err
+	} else if !active {
+		result.Err = errors.New("the network is not active")
+	}
+
+	results := []CheckResult{result}
+
+	if result.Err != nil {
+		return results
+	}
+
+	bridge := CheckResult{
+		Name: fmt.Sprintf("Bridge '%s' exists", config.Network.BridgeName),
+		Hint: "The network was created with other settings than the config, remove the network and let lab-cli create it again",
+	}
+
+	bridgeName, err := network.GetBridgeName()
+	if err != nil {
+		bridge.Err = err
+	} else if bridgeName != config.Network.BridgeName {
+		bridge.Err = fmt.Errorf("the network uses the bridge '%s'", bridgeName)
+	} else if _, err := net.InterfaceByName(bridgeName); err != nil {
+		bridge.Err = err
+	}
+
+	return append(results, bridge)
+}
+
+func checkPrivateKey(config *Config) CheckResult {
+	keyFile := config.AnsiblePrivateKeyPath
+
+	result := CheckResult{
+		Name: fmt.Sprintf("Private key %s exists with correct permissions", keyFile),
+		Hint: "Create a key pair with 'lab-cli keygen' and set ansible_private_key_path in the config, the file should only be readable by you (chmod 600)",
+	}
+
+	info, err := os.Stat(keyFile)
+	if err != nil {
+		result.Err = err
+	} else if info.Mode().Perm()&0077 != 0 {
+		// ssh refuses to use a private key that others can read
+		result.Err = fmt.Errorf("the permissions are %#o", info.Mode().Perm())
+	}
+
+	return result
+}
@@ -0,0 +1,646 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	libvirt "libvirt.org/libvirt-go"
+)
+
+type GCOptions struct {
+	Apply bool
+	Yes   bool
+}
+
+type NetworkDNS struct {
+	Hosts []DNSHostXML `xml:"host"`
+}
+
+type DNSHostXML struct {
+	XMLName   xml.Name `xml:"host"`
+	IP        net.IP   `xml:"ip,attr"`
+	Hostnames []string `xml:"hostname"`
+}
+
+// Something that was left behind. Orphans without remove are only reported,
+// they need a decision that gc can't make.
+type orphan struct {
+	Kind   string
+	Name   string
+	Reason string
+	remove func() error
+}
+
+// What the existing domains use, everything else is an orphan
+type gcState struct {
+	names     map[string]bool
+	macs      map[string]bool
+	addresses map[string]bool
+	files     map[string]int
+}
+
+func gcCommand(args []string, config *Config) error {
+	// Parse arguments
+	options, err := parseGC(args)
+	if err != nil {
+		return err
+	}
+
+	// Create a libvirt connection
+	conn, err := libvirt.NewConnect("qemu:///system")
+	if err != nil {
+		return err
+	}
+
+	state, orphans, err := getDomainState(conn)
+	if err != nil {
+		return err
+	}
+
+	collectors := []func(*libvirt.Connect, *Config, *gcState) ([]orphan, error){
+		orphanVolumes,
+		orphanNetworkHosts,
+		orphanStateFiles,
+		orphanKnownHosts,
+	}
+
+	for _, collect := range collectors {
+		found, err := collect(conn, config, state)
+		if err != nil {
+			return err
+		}
+
+		orphans = append(orphans, found...)
+	}
+
+	if len(orphans) == 0 {
+		fmt.Println("Nothing to clean up")
+		return nil
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "KIND\tNAME\tREASON")
+
+	for _, o := range orphans {
+		fmt.Fprintf(writer, "%s\t%s\t%s\n", o.Kind, o.Name, o.Reason)
+	}
+
+	writer.Flush()
+
+	if !options.Apply {
+		fmt.Println("\nNothing has been removed, run 'lab-cli gc --apply' to remove them")
+		return nil
+	}
+
+	fmt.Println()
+
+	if !options.Yes {
+		removable := 0
+		for _, o := range orphans {
+			if o.remove != nil {
+				removable++
+			}
+		}
+
+		confirmed, err := confirm(fmt.Sprintf("%d of them will be removed, the others have to be fixed by hand\n", removable))
+		if err != nil {
+			return err
+		}
+
+		if !confirmed {
+			fmt.Println("Nothing was removed")
+			return nil
+		}
+	}
+
+	failed := 0
+
+	for _, o := range orphans {
+		if o.remove == nil {
+			fmt.Printf("Skipping %s %s, it has to be fixed by hand\n", o.Kind, o.Name)
+			continue
+		}
+
+		if err := o.remove(); err != nil {
+			fmt.Printf("Could not remove %s %s: %s\n", o.Kind, o.Name, err)
+			failed++
+			continue
+		}
+
+		fmt.Printf("Removed %s %s\n", o.Kind, o.Name)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d could not be removed", failed, len(orphans))
+	}
+
+	return nil
+}
+
+// Collect what all domains use, and report lab-cli domains with a description that
+// can't be parsed or an address that another domain also has. They are never removed
+// by gc, since that would throw away a VM.
+func getDomainState(conn *libvirt.Connect) (*gcState, []orphan, error) {
+	state := &gcState{
+		names:     make(map[string]bool),
+		macs:      make(map[string]bool),
+		addresses: make(map[string]bool),
+	}
+
+	var orphans []orphan
+
+	domains, err := conn.ListAllDomains(0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	owners := make(map[string]string)
+
+	for _, domain := range domains {
+		name, err := domain.GetName()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		state.names[name] = true
+
+		macs, err := getDomainMACs(&domain)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, mac := range macs {
+			state.macs[strings.ToLower(mac)] = true
+		}
+
+		desc, err := getDomainDesc(&domain)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if !strings.HasPrefix(desc, "labcli:") {
+			continue
+		}
+
+		summary, err := getDomainSummary(&domain)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if summary.Problem != "" {
+			orphans = append(orphans, orphan{
+				Kind:   "domain",
+				Name:   name,
+				Reason: summary.Problem + ", fix it with 'lab-cli repair'",
+			})
+
+			// The guessed address is still kept away from known_hosts and DNS cleanup
+			if summary.Address != nil {
+				state.addresses[summary.Address.String()] = true
+			}
+
+			continue
+		}
+
+		address := summary.Address.String()
+
+		if owner, exists := owners[address]; exists {
+			orphans = append(orphans, orphan{
+				Kind:   "domain",
+				Name:   name,
+				Reason: fmt.Sprintf("has the address %s, like '%s'", address, owner),
+			})
+			continue
+		}
+
+		owners[address] = name
+		state.addresses[address] = true
+	}
+
+	for i := range domains {
+		domains[i].Free()
+	}
+
+	state.files, err = getUsedDiskFiles(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return state, orphans, nil
+}
+
+// Volumes in the storage pool that no domain uses. Only the volumes of imported media
+// are known to belong to lab-cli, the others are only reported since the pool can be
+// shared and disks can be kept on purpose with 'remove --keep-disks'. Other ISO images
+// are left out, installers are often kept in the pool.
+func orphanVolumes(conn *libvirt.Connect, config *Config, state *gcState) ([]orphan, error) {
+	pool, err := conn.LookupStoragePoolByName(config.StoragePool)
+	if err != nil {
+		return nil, err
+	}
+	defer pool.Free()
+
+	volumes, err := pool.ListAllStorageVolumes(0)
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := loadMediaIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	keep := make(map[string]bool)
+
+	for _, media := range index {
+		for _, file := range media.Volumes {
+			keep[file] = true
+		}
+	}
+
+	for _, distro := range distros {
+		keep[getDistroConfig(config, distro).Location] = true
+	}
+
+	var orphans []orphan
+
+	for i := range volumes {
+		volume := volumes[i]
+
+		file, err := volume.GetPath()
+		if err != nil {
+			return nil, err
+		}
+
+		name, err := volume.GetName()
+		if err != nil {
+			return nil, err
+		}
+
+		volume.Free()
+
+		if state.files[file] > 0 || keep[file] {
+			continue
+		}
+
+		if !strings.HasPrefix(name, "labcli-media-") {
+			if !strings.HasSuffix(name, ".iso") {
+				orphans = append(orphans, orphan{
+					Kind:   "volume",
+					Name:   file,
+					Reason: "not used by any VM, it may have been kept on purpose",
+				})
+			}
+
+			continue
+		}
+
+		orphans = append(orphans, orphan{
+			Kind:   "volume",
+			Name:   file,
+			Reason: "imported media that is not in the media index",
+			remove: func() error {
+				return deleteMediaVolumes(conn, []string{file})
+			},
+		})
+	}
+
+	return orphans, nil
+}
+
+// DHCP host entries for MAC addresses that no domain has, and DNS entries for addresses in the lab range that no VM has
+func orphanNetworkHosts(conn *libvirt.Connect, config *Config, state *gcState) ([]orphan, error) {
+	network, err := getNetwork(conn, config)
+	if err != nil {
+		if strings.Contains(err.Error(), "Network not found") {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	xmlDesc, err := network.GetXMLDesc(0)
+	if err != nil {
+		return nil, err
+	}
+
+	var parsedNetwork NetworkXML
+	if err := xml.Unmarshal([]byte(xmlDesc), &parsedNetwork); err != nil {
+		return nil, err
+	}
+
+	var orphans []orphan
+
+	if parsedNetwork.IP.DHCP != nil {
+		for _, host := range parsedNetwork.IP.DHCP.Hosts {
+			host := host
+
+			if state.macs[strings.ToLower(host.MAC)] {
+				continue
+			}
+
+			orphans = append(orphans, orphan{
+				Kind:   "dhcp-host",
+				Name:   fmt.Sprintf("%s (%s, %s)", host.MAC, host.Name, host.IP),
+				Reason: "no VM has the MAC address",
+				remove: func() error {
+					return updateDHCPHost(network, libvirt.NETWORK_UPDATE_COMMAND_DELETE, host.MAC, host.Name, host.IP)
+				},
+			})
+		}
+	}
+
+	if parsedNetwork.DNS != nil {
+		for _, host := range parsedNetwork.DNS.Hosts {
+			host := host
+
+			if !inRange(host.IP, config.Network.RangeStart, config.Network.RangeEnd) || state.addresses[host.IP.String()] {
+				continue
+			}
+
+			orphans = append(orphans, orphan{
+				Kind:   "dns-host",
+				Name:   fmt.Sprintf("%s (%s)", host.IP, strings.Join(host.Hostnames, ", ")),
+				Reason: "no VM has the address",
+				remove: func() error {
+					return updateNetwork(network, libvirt.NETWORK_UPDATE_COMMAND_DELETE, libvirt.NETWORK_SECTION_DNS_HOST, host)
+				},
+			})
+		}
+	}
+
+	return orphans, nil
+}
+
+// Install logs, passwords and PXE scripts of VMs that don't exist, and imported media whose volumes are gone
+func orphanStateFiles(conn *libvirt.Connect, config *Config, state *gcState) ([]orphan, error) {
+	var orphans []orphan
+
+	stateDir, err := getStateDir()
+	if err != nil {
+		return nil, err
+	}
+
+	logDir := path.Join(stateDir, "logs")
+
+	logs, err := ioutil.ReadDir(logDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	for _, log := range logs {
+		name := strings.TrimSuffix(log.Name(), "-install.log")
+		if name == log.Name() || state.names[name] {
+			continue
+		}
+
+		file := path.Join(logDir, log.Name())
+
+		orphans = append(orphans, orphan{
+			Kind:   "log",
+			Name:   file,
+			Reason: fmt.Sprintf("'%s' does not exist", name),
+			remove: func() error {
+				return os.Remove(file)
+			},
+		})
+	}
+
+	secrets, err := loadSecrets()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range sortedSecretNames(secrets) {
+		name := name
+
+		if state.names[name] {
+			continue
+		}
+
+		orphans = append(orphans, orphan{
+			Kind:   "secret",
+			Name:   name,
+			Reason: fmt.Sprintf("'%s' does not exist", name),
+			remove: func() error {
+				return storeSecrets(name, nil)
+			},
+		})
+	}
+
+	if config.PXE.TFTPRoot != "" {
+		scripts, err := ioutil.ReadDir(config.PXE.TFTPRoot)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		for _, script := range scripts {
+			if script.Name() == pxeBootFile || !strings.HasSuffix(script.Name(), ".ipxe") {
+				continue
+			}
+
+			mac := strings.ReplaceAll(strings.TrimSuffix(script.Name(), ".ipxe"), "-", ":")
+			if state.macs[mac] {
+				continue
+			}
+
+			file := path.Join(config.PXE.TFTPRoot, script.Name())
+
+			orphans = append(orphans, orphan{
+				Kind:   "pxe-script",
+				Name:   file,
+				Reason: "no VM has the MAC address",
+				remove: func() error {
+					return os.Remove(file)
+				},
+			})
+		}
+	}
+
+	index, err := loadMediaIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, distro := range distros {
+		distro := distro
+
+		media, exists := index[distro]
+		if !exists || mediaVolumesExist(conn, &media) {
+			continue
+		}
+
+		orphans = append(orphans, orphan{
+			Kind:   "media",
+			Name:   distro,
+			Reason: "the volumes are missing",
+			remove: func() error {
+				index, err := loadMediaIndex()
+				if err != nil {
+					return err
+				}
+
+				delete(index, distro)
+
+				return saveMediaIndex(index)
+			},
+		})
+	}
+
+	return orphans, nil
+}
+
+// Host keys in known_hosts for addresses in the lab range that no VM has. The
+// next VM that gets the address has a new key and ssh would complain.
+func orphanKnownHosts(conn *libvirt.Connect, config *Config, state *gcState) ([]orphan, error) {
+	knownHosts, err := getKnownHostsFile()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(knownHosts)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	var orphans []orphan
+
+	end := nextAddress(config.Network.RangeEnd)
+
+	for ip := config.Network.RangeStart; ip != nil && !ip.Equal(end); ip = nextAddress(ip) {
+		address := ip.String()
+
+		if state.addresses[address] || !knownHostsContains(string(data), address) {
+			continue
+		}
+
+		orphans = append(orphans, orphan{
+			Kind:   "known-host",
+			Name:   address,
+			Reason: "no VM has the address",
+			remove: func() error {
+				return removeKnownHost(knownHosts, address)
+			},
+		})
+	}
+
+	return orphans, nil
+}
+
+func getKnownHostsFile() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return path.Join(home, ".ssh", "known_hosts"), nil
+}
+
+// Remove all keys for host from a known_hosts file
+func removeKnownHost(knownHosts string, host string) error {
+	output, err := exec.Command("/usr/bin/ssh-keygen", "-R", host, "-f", knownHosts).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ssh-keygen failed: %s\n%s", err, output)
+	}
+
+	return nil
+}
+
+// Whether a known_hosts file has a key for host, also when the host names are hashed
+func knownHostsContains(data string, host string) bool {
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		// @cert-authority and @revoked come before the host names
+		patterns := fields[0]
+		if strings.HasPrefix(patterns, "@") {
+			patterns = fields[1]
+		}
+
+		for _, pattern := range strings.Split(patterns, ",") {
+			if pattern == host || pattern == "["+host+"]:22" {
+				return true
+			}
+
+			if strings.HasPrefix(pattern, "|1|") && hashedHostMatches(pattern, host) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// A hashed host name is |1|base64(salt)|base64(HMAC-SHA1(salt, host))
+func hashedHostMatches(pattern string, host string) bool {
+	parts := strings.Split(pattern, "|")
+	if len(parts) != 4 {
+		return false
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+
+	hash, err := base64.StdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(host))
+
+	return hmac.Equal(mac.Sum(nil), hash)
+}
+
+func inRange(ip net.IP, start net.IP, end net.IP) bool {
+	ip = ip.To4()
+	if ip == nil {
+		return false
+	}
+
+	return string(ip) >= string(start.To4()) && string(ip) <= string(end.To4())
+}
+
+func sortedSecretNames(secrets map[string]Secrets) []string {
+	var keys []string
+	for key := range secrets {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+func parseGC(args []string) (*GCOptions, error) {
+	command := flag.NewFlagSet("gc", flag.ExitOnError)
+	apply := command.Bool("apply", false, "remove what was found, otherwise it is only shown")
+	yes := command.Bool("yes", false, "remove without asking for confirmation")
+
+	command.Parse(args[2:])
+
+	options := &GCOptions{Apply: *apply, Yes: *yes}
+
+	return options, nil
+}
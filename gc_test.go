@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/xml"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestKnownHostsContains(t *testing.T) {
+	// The second line was hashed with ssh-keygen -H from an entry for 192.168.100.51
+	data := `# comment
+192.168.100.50,lab01.lab.local ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl
+|1|mIdFBhonLvO6/p5IG3Gk+M4MnOE=|CTGGCDT/pN7xMI51dkOUUsuKNIM= ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl
+@revoked 192.168.100.52 ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl
+[192.168.100.53]:22 ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl
+`
+
+	var tests = []struct {
+		host string
+		want bool
+	}{
+		{"192.168.100.50", true},
+		{"lab01.lab.local", true},
+		{"192.168.100.51", true},
+		{"192.168.100.52", true},
+		{"192.168.100.53", true},
+		{"192.168.100.5", false},
+		{"192.168.100.54", false},
+	}
+
+	for _, test := range tests {
+		if got := knownHostsContains(data, test.host); got != test.want {
+			t.Errorf("unexpected result for %s. got: %t, want: %t", test.host, got, test.want)
+		}
+	}
+}
+
+func TestInRange(t *testing.T) {
+	start := net.ParseIP("192.168.100.10")
+	end := net.ParseIP("192.168.100.20")
+
+	var tests = []struct {
+		ip   net.IP
+		want bool
+	}{
+		{net.ParseIP("192.168.100.10"), true},
+		{net.ParseIP("192.168.100.15"), true},
+		{net.ParseIP("192.168.100.20"), true},
+		{net.ParseIP("192.168.100.9"), false},
+		{net.ParseIP("192.168.100.21"), false},
+		{net.ParseIP("192.168.101.15"), false},
+		{nil, false},
+	}
+
+	for _, test := range tests {
+		if got := inRange(test.ip, start, end); got != test.want {
+			t.Errorf("unexpected result for %s. got: %t, want: %t", test.ip, got, test.want)
+		}
+	}
+}
+
+func TestNetworkXMLHosts(t *testing.T) {
+	data := `<network>
+  <name>labnet</name>
+  <dns>
+    <host ip="192.168.100.50"><hostname>lab01</hostname></host>
+  </dns>
+  <ip address="192.168.100.1" netmask="255.255.255.0">
+    <dhcp>
+      <host mac="52:54:00:aa:bb:cc" name="lab02" ip="192.168.100.51"/>
+    </dhcp>
+  </ip>
+</network>`
+
+	var network NetworkXML
+	if err := xml.Unmarshal([]byte(data), &network); err != nil {
+		t.Fatal(err)
+	}
+
+	if network.DNS == nil || len(network.DNS.Hosts) != 1 || network.DNS.Hosts[0].Hostnames[0] != "lab01" {
+		t.Errorf("the DNS host was not parsed: %+v", network.DNS)
+	}
+
+	if network.IP.DHCP == nil || len(network.IP.DHCP.Hosts) != 1 || network.IP.DHCP.Hosts[0].MAC != "52:54:00:aa:bb:cc" {
+		t.Errorf("the DHCP host was not parsed: %+v", network.IP.DHCP)
+	}
+
+	want := []net.IP{net.ParseIP("192.168.100.51"), net.ParseIP("192.168.100.50")}
+	if got := networkHostAddresses(&network); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if got := networkHostAddresses(&NetworkXML{}); got != nil {
+		t.Errorf("got %v for a network without hosts", got)
+	}
+}
+
+func TestParseGC(t *testing.T) {
+	var tests = []struct {
+		args []string
+		want *GCOptions
+	}{
+		{[]string{"lab-cli", "gc"}, &GCOptions{}},
+		{[]string{"lab-cli", "gc", "--apply"}, &GCOptions{Apply: true}},
+		{[]string{"lab-cli", "gc", "--apply", "--yes"}, &GCOptions{Apply: true, Yes: true}},
+	}
+
+	for _, test := range tests {
+		options, err := parseGC(test.args)
+		if err != nil {
+			t.Errorf("unexpected error for %v: %s", test.args, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(options, test.want) {
+			t.Errorf("got %+v for %v, want %+v", options, test.args, test.want)
+		}
+	}
+}
@@ -1,8 +1,11 @@
 module github.com/jagardaniel/lab-cli
 
-go 1.14
+go 1.16
 
 require (
 	github.com/BurntSushi/toml v0.3.1
+	golang.org/x/crypto v0.11.0
+	golang.org/x/term v0.10.0
+	gopkg.in/yaml.v2 v2.4.0
 	libvirt.org/libvirt-go v6.1.0+incompatible
 )
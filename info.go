@@ -0,0 +1,373 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	libvirt "libvirt.org/libvirt-go"
+)
+
+type InfoOptions struct {
+	Name string
+	JSON bool
+}
+
+type DomainInfo struct {
+	Name       string            `json:"name"`
+	Address    net.IP            `json:"ip"`
+	Groups     []string          `json:"groups"`
+	Vars       []DomainVar       `json:"vars"`
+	Distro     string            `json:"distro"`
+	CreatedAt  *time.Time        `json:"created_at"`
+	KernelArgs []string          `json:"kernel_args"`
+	VirtArgs   []string          `json:"virt_install_args"`
+	State      string            `json:"state"`
+	Reason     string            `json:"reason"`
+	Memory     int               `json:"memory"`
+	MaxMemory  int               `json:"max_memory"`
+	VCPUs      int               `json:"vcpus"`
+	Disks      []DomainInfoDisk  `json:"disks"`
+	Interfaces []DomainInterface `json:"interfaces"`
+	Snapshots  []string          `json:"snapshots"`
+	VNC        string            `json:"vnc"`
+	Serial     string            `json:"serial"`
+	SSH        string            `json:"ssh"`
+	Problem    string            `json:"problem,omitempty"`
+}
+
+type DomainInfoDisk struct {
+	Target     string `json:"target"`
+	Path       string `json:"path"`
+	Capacity   uint64 `json:"capacity"`
+	Allocation uint64 `json:"allocation"`
+}
+
+type DomainInterface struct {
+	MAC     string `json:"mac"`
+	Network string `json:"network"`
+}
+
+func infoCommand(args []string, config *Config) error {
+	// Parse arguments
+	options, err := parseInfo(args)
+	if err != nil {
+		return err
+	}
+
+	// Create a libvirt connection
+	conn, err := libvirt.NewConnect("qemu:///system")
+	if err != nil {
+		return err
+	}
+
+	domain, err := getExistingDomain(conn, options.Name)
+	if err != nil {
+		return err
+	}
+
+	desc, err := getDomainDesc(domain)
+	if err != nil {
+		return err
+	}
+
+	if !strings.HasPrefix(desc, "labcli:") {
+		return fmt.Errorf("'%s' is not managed by lab-cli", options.Name)
+	}
+
+	info, err := getDomainInfo(conn, domain, config)
+	if err != nil {
+		return err
+	}
+
+	if options.JSON {
+		data, err := json.MarshalIndent(info, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(string(data))
+		return nil
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintf(writer, "Name:\t%s\n", info.Name)
+
+	if info.Problem != "" {
+		fmt.Fprintf(writer, "Problem:\t%s, fix it with 'lab-cli repair'\n", info.Problem)
+	}
+
+	fmt.Fprintf(writer, "State:\t%s (%s)\n", info.State, info.Reason)
+	fmt.Fprintf(writer, "IP Address:\t%s\n", info.Address)
+	fmt.Fprintf(writer, "Ansible groups:\t%s\n", strings.Join(info.Groups, ", "))
+
+	for _, v := range info.Vars {
+		fmt.Fprintf(writer, "Variable:\t%s=%s\n", v.Name, v.Value)
+	}
+
+	fmt.Fprintf(writer, "Distro:\t%s\n", info.Distro)
+
+	if info.CreatedAt != nil {
+		fmt.Fprintf(writer, "Created:\t%s\n", info.CreatedAt.Format(time.RFC3339))
+	}
+
+	if len(info.KernelArgs) > 0 {
+		fmt.Fprintf(writer, "Kernel arguments:\t%s\n", strings.Join(info.KernelArgs, " "))
+	}
+
+	if len(info.VirtArgs) > 0 {
+		fmt.Fprintf(writer, "virt-install arguments:\t%s\n", shellJoin(info.VirtArgs))
+	}
+
+	fmt.Fprintf(writer, "RAM:\t%d MiB (max %d MiB)\n", info.Memory, info.MaxMemory)
+	fmt.Fprintf(writer, "VCPUs:\t%d\n", info.VCPUs)
+
+	for _, disk := range info.Disks {
+		fmt.Fprintf(writer, "Disk %s:\t%s (%.1f GB, %.1f GB used)\n", disk.Target, disk.Path,
+			float64(disk.Capacity)/1024/1024/1024, float64(disk.Allocation)/1024/1024/1024)
+	}
+
+	for _, iface := range info.Interfaces {
+		fmt.Fprintf(writer, "Interface:\t%s (network %s)\n", iface.MAC, iface.Network)
+	}
+
+	if len(info.Snapshots) > 0 {
+		fmt.Fprintf(writer, "Snapshots:\t%s\n", strings.Join(info.Snapshots, ", "))
+	}
+
+	if info.VNC != "" {
+		fmt.Fprintf(writer, "VNC:\t%s\n", info.VNC)
+	}
+
+	if info.Serial != "" {
+		fmt.Fprintf(writer, "Serial console:\t%s\n", info.Serial)
+	}
+
+	fmt.Fprintf(writer, "SSH:\t%s\n", info.SSH)
+
+	writer.Flush()
+
+	return nil
+}
+
+func getDomainInfo(conn *libvirt.Connect, domain *libvirt.Domain, config *Config) (*DomainInfo, error) {
+	// Devices that are not covered by getDomainDisks. The ports and paths are only
+	// set in the live XML when the VM is running.
+	type DomainXML struct {
+		Interfaces []struct {
+			MAC struct {
+				Address string `xml:"address,attr"`
+			} `xml:"mac"`
+			Source struct {
+				Network string `xml:"network,attr"`
+			} `xml:"source"`
+		} `xml:"devices>interface"`
+		Graphics []struct {
+			Type   string `xml:"type,attr"`
+			Port   int    `xml:"port,attr"`
+			Listen string `xml:"listen,attr"`
+		} `xml:"devices>graphics"`
+		Serials []struct {
+			Source struct {
+				Path string `xml:"path,attr"`
+			} `xml:"source"`
+		} `xml:"devices>serial"`
+	}
+
+	summary, err := getDomainSummary(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata, metadataProblem, err := readDomainMetadata(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	state, reason, err := domain.GetState()
+	if err != nil {
+		return nil, err
+	}
+
+	domainInfo, err := domain.GetInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	xmlDesc, err := domain.GetXMLDesc(0)
+	if err != nil {
+		return nil, err
+	}
+
+	var parsedDomain DomainXML
+	if err := xml.Unmarshal([]byte(xmlDesc), &parsedDomain); err != nil {
+		return nil, err
+	}
+
+	disks, err := getDomainDisks(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	var infoDisks []DomainInfoDisk
+
+	for _, disk := range disks {
+		infoDisk := DomainInfoDisk{
+			Target: disk.Target.Dev,
+			Path:   disk.Source.File,
+		}
+
+		// The size is left empty if the volume is missing
+		volume, err := conn.LookupStorageVolByPath(disk.Source.File)
+		if err == nil {
+			volumeInfo, err := volume.GetInfo()
+			if err != nil {
+				return nil, err
+			}
+
+			infoDisk.Capacity = volumeInfo.Capacity
+			infoDisk.Allocation = volumeInfo.Allocation
+		}
+
+		infoDisks = append(infoDisks, infoDisk)
+	}
+
+	snapshots, err := domain.ListAllSnapshots(0)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshotNames []string
+
+	for _, snapshot := range snapshots {
+		name, err := snapshot.GetName()
+		if err != nil {
+			return nil, err
+		}
+
+		snapshotNames = append(snapshotNames, name)
+		snapshot.Free()
+	}
+
+	info := &DomainInfo{
+		Name:       summary.Name,
+		Address:    summary.Address,
+		Groups:     summary.Groups,
+		Vars:       metadata.Vars,
+		Distro:     metadata.Distro,
+		CreatedAt:  metadata.CreatedAt,
+		KernelArgs: append(append([]string(nil), metadata.ConfigKernelArgs...), metadata.KernelArgs...),
+		VirtArgs:   metadata.VirtInstallArgs,
+		State:      domainStateName(state),
+		Reason:     domainStateReason(state, reason),
+		Memory:     int(domainInfo.Memory / 1024),
+		MaxMemory:  int(domainInfo.MaxMem / 1024),
+		VCPUs:      int(domainInfo.NrVirtCpu),
+		Disks:      infoDisks,
+		Snapshots:  snapshotNames,
+		SSH:        "ssh " + strings.Join(sshArguments(config, summary.Address), " "),
+		Problem:    joinProblems(summary.Problem, metadataProblem),
+	}
+
+	for _, iface := range parsedDomain.Interfaces {
+		info.Interfaces = append(info.Interfaces, DomainInterface{
+			MAC:     iface.MAC.Address,
+			Network: iface.Source.Network,
+		})
+	}
+
+	for _, graphics := range parsedDomain.Graphics {
+		if graphics.Type == "vnc" && graphics.Port > 0 {
+			info.VNC = fmt.Sprintf("vnc://%s:%d", graphics.Listen, graphics.Port)
+		}
+	}
+
+	if len(parsedDomain.Serials) > 0 {
+		info.Serial = parsedDomain.Serials[0].Source.Path
+	}
+
+	return info, nil
+}
+
+// Human readable reason for the current state of the domain
+func domainStateReason(state libvirt.DomainState, reason int) string {
+	switch state {
+	case libvirt.DOMAIN_RUNNING:
+		switch libvirt.DomainRunningReason(reason) {
+		case libvirt.DOMAIN_RUNNING_BOOTED:
+			return "booted"
+		case libvirt.DOMAIN_RUNNING_MIGRATED:
+			return "migrated"
+		case libvirt.DOMAIN_RUNNING_RESTORED:
+			return "restored"
+		case libvirt.DOMAIN_RUNNING_FROM_SNAPSHOT:
+			return "restored from snapshot"
+		case libvirt.DOMAIN_RUNNING_UNPAUSED:
+			return "unpaused"
+		case libvirt.DOMAIN_RUNNING_WAKEUP:
+			return "woken up"
+		case libvirt.DOMAIN_RUNNING_CRASHED:
+			return "running after crash"
+		}
+	case libvirt.DOMAIN_PAUSED:
+		switch libvirt.DomainPausedReason(reason) {
+		case libvirt.DOMAIN_PAUSED_USER:
+			return "paused by user"
+		case libvirt.DOMAIN_PAUSED_IOERROR:
+			return "I/O error"
+		case libvirt.DOMAIN_PAUSED_WATCHDOG:
+			return "watchdog"
+		case libvirt.DOMAIN_PAUSED_SNAPSHOT:
+			return "creating snapshot"
+		case libvirt.DOMAIN_PAUSED_CRASHED:
+			return "crashed"
+		}
+	case libvirt.DOMAIN_SHUTOFF:
+		switch libvirt.DomainShutoffReason(reason) {
+		case libvirt.DOMAIN_SHUTOFF_SHUTDOWN:
+			return "shut down"
+		case libvirt.DOMAIN_SHUTOFF_DESTROYED:
+			return "destroyed"
+		case libvirt.DOMAIN_SHUTOFF_CRASHED:
+			return "crashed"
+		case libvirt.DOMAIN_SHUTOFF_SAVED:
+			return "saved"
+		case libvirt.DOMAIN_SHUTOFF_FAILED:
+			return "failed to start"
+		case libvirt.DOMAIN_SHUTOFF_FROM_SNAPSHOT:
+			return "restored from snapshot"
+		}
+	case libvirt.DOMAIN_CRASHED:
+		if libvirt.DomainCrashedReason(reason) == libvirt.DOMAIN_CRASHED_PANICKED {
+			return "guest panicked"
+		}
+	}
+
+	return "unknown"
+}
+
+func parseInfo(args []string) (*InfoOptions, error) {
+	command := flag.NewFlagSet("info", flag.ExitOnError)
+	jsonOutput := command.Bool("json", false, "print the information as JSON")
+
+	command.Parse(args[2:])
+
+	if len(command.Args()) < 1 {
+		return nil, errors.New("info subcommand requires a name")
+	}
+
+	options := &InfoOptions{
+		Name: command.Args()[0],
+		JSON: *jsonOutput,
+	}
+
+	return options, nil
+}
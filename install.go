@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	libvirt "libvirt.org/libvirt-go"
+)
+
+type LogsOptions struct {
+	Name   string
+	Follow bool
+}
+
+// Lines from the installers that mean the installation has failed or is stuck
+// waiting for input that will never come
+var installFailureMarkers = []string{
+	// debian-installer marks questions with critical priority with [!!]
+	"[!!]",
+	"An installation step failed",
+	// anaconda
+	"An unknown error has occurred",
+	"Traceback (most recent call last)",
+	"The following problem occurred on line",
+	"There was an error running the kickstart script",
+	"Pane is dead",
+}
+
+// Terminal escape sequences that the installers use to draw their interface
+var escapeSequence = regexp.MustCompile(`\x1b(\[[0-9;?]*[a-zA-Z]|[()][0-9A-B]|[=>])`)
+
+// Writes the console output to the install log and looks for failures
+type installWatcher struct {
+	out     io.Writer
+	line    []byte
+	once    sync.Once
+	Failure string
+	Failed  chan struct{}
+}
+
+func newInstallWatcher(out io.Writer) *installWatcher {
+	return &installWatcher{
+		out:    out,
+		Failed: make(chan struct{}),
+	}
+}
+
+func (w *installWatcher) Write(p []byte) (int, error) {
+	w.line = append(w.line, p...)
+
+	// Only look at complete lines, the rest is kept until the next write.
+	// The installer interfaces often only use carriage returns.
+	for {
+		i := bytes.IndexAny(w.line, "\r\n")
+		if i < 0 {
+			break
+		}
+
+		w.check(string(w.line[:i]))
+		w.line = w.line[i+1:]
+	}
+
+	return w.out.Write(p)
+}
+
+func (w *installWatcher) check(line string) {
+	line = strings.TrimSpace(escapeSequence.ReplaceAllString(line, ""))
+
+	for _, marker := range installFailureMarkers {
+		if strings.Contains(line, marker) {
+			w.once.Do(func() {
+				w.Failure = line
+				close(w.Failed)
+			})
+		}
+	}
+}
+
+// Log the serial console of the domain until the installation is finished (the VM
+// shuts down) or the installer reports a failure
+func followInstall(conn *libvirt.Connect, domain *libvirt.Domain, watcher *installWatcher) error {
+	// Nobody else should have the console of a new VM, but a previous lab-cli could still hold it
+	stream, err := openConsole(conn, domain, true)
+	if err != nil {
+		return err
+	}
+	defer stream.Free()
+
+	done := make(chan error, 1)
+
+	go func() {
+		buf := make([]byte, 1024)
+
+		for {
+			n, err := stream.Recv(buf)
+			if err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+
+				done <- err
+				return
+			}
+
+			watcher.Write(buf[:n])
+		}
+	}()
+
+	select {
+	case err = <-done:
+	case <-watcher.Failed:
+		// Wait for the reader, it still writes to the log
+		stream.Abort()
+		<-done
+	}
+
+	return err
+}
+
+// Create (or truncate) the install log for a VM
+func createInstallLog(name string) (*os.File, error) {
+	logFile, err := getInstallLogPath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(path.Dir(logFile), 0755); err != nil {
+		return nil, err
+	}
+
+	return os.Create(logFile)
+}
+
+func getInstallLogPath(name string) (string, error) {
+	stateDir, err := getStateDir()
+	if err != nil {
+		return "", err
+	}
+
+	return path.Join(stateDir, "logs", fmt.Sprintf("%s-install.log", name)), nil
+}
+
+func logsCommand(args []string) error {
+	// Parse arguments
+	options, err := parseLogs(args)
+	if err != nil {
+		return err
+	}
+
+	logFile, err := getInstallLogPath(options.Name)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(logFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("there is no install log for '%s'", options.Name)
+		}
+
+		return err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(os.Stdout, f); err != nil {
+		return err
+	}
+
+	// Keep printing new output as it is written, until interrupted
+	for options.Follow {
+		time.Sleep(500 * time.Millisecond)
+
+		if _, err := io.Copy(os.Stdout, f); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func parseLogs(args []string) (*LogsOptions, error) {
+	command := flag.NewFlagSet("logs", flag.ExitOnError)
+	follow := command.Bool("follow", false, "keep printing the log as it is written")
+
+	command.Parse(args[2:])
+
+	if len(command.Args()) < 1 {
+		return nil, errors.New("logs subcommand requires a name")
+	}
+
+	options := &LogsOptions{
+		Name:   command.Args()[0],
+		Follow: *follow,
+	}
+
+	return options, nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestInstallWatcher(t *testing.T) {
+	var tests = []struct {
+		output  []string
+		failure string
+	}{
+		{[]string{"Loading additional components...\r\n", "Installing the base system\r\n"}, ""},
+		{[]string{"\x1b[1;37m  [!!] Configure the", " network  \x1b[0m\r\n"}, "[!!] Configure the network"},
+		{[]string{"Starting installer\n", "An unknown error has occurred\nTraceback (most recent call last):\n"}, "An unknown error has occurred"},
+		// Not a complete line yet
+		{[]string{"[!!] Partition disks"}, ""},
+	}
+
+	for _, test := range tests {
+		var log bytes.Buffer
+		watcher := newInstallWatcher(&log)
+
+		for _, output := range test.output {
+			watcher.Write([]byte(output))
+		}
+
+		if watcher.Failure != test.failure {
+			t.Errorf("did not detect the failure we wanted. got: %q, want: %q", watcher.Failure, test.failure)
+		}
+
+		var want bytes.Buffer
+		for _, output := range test.output {
+			want.WriteString(output)
+		}
+
+		if log.String() != want.String() {
+			t.Errorf("the log does not contain all output. got: %q, want: %q", log.String(), want.String())
+		}
+	}
+}
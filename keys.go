@@ -0,0 +1,277 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	libvirt "libvirt.org/libvirt-go"
+)
+
+// Name of the key pair that keygen creates in the config directory
+const defaultKeyName = "ansible_ed25519"
+
+type KeygenOptions struct {
+	Force bool
+}
+
+// Create a new key pair in the config directory
+func keygenCommand(args []string) error {
+	options, err := parseKeygen(args)
+	if err != nil {
+		return err
+	}
+
+	configDir, err := getConfigDir()
+	if err != nil {
+		return err
+	}
+
+	keyFile := path.Join(configDir, defaultKeyName)
+
+	if _, err := os.Stat(keyFile); err == nil && !options.Force {
+		return fmt.Errorf("%s already exists, use --force to replace it", keyFile)
+	}
+
+	if err := generateKeyPair(keyFile); err != nil {
+		return err
+	}
+
+	fmt.Printf("Created %s and %s.pub\n\n", keyFile, keyFile)
+	fmt.Println("Use the key pair for new VMs by adding this to config.toml (relative paths are relative to the config directory):")
+	fmt.Printf("ansible_public_key_file = \"%s.pub\"\n", defaultKeyName)
+	fmt.Printf("ansible_private_key_path = \"%s\"\n", defaultKeyName)
+
+	return nil
+}
+
+// The key pair from the last rotation may be the only one that stopped VMs accept, so
+// it must not be replaced by the next rotation
+func checkNoOldKeys(privateKeyPath string, publicKeyFile string) error {
+	for _, file := range []string{privateKeyPath + ".old", publicKeyFile + ".old"} {
+		_, err := os.Stat(file)
+		if err == nil {
+			return fmt.Errorf("%s is left from an earlier rotation and VMs that were not running may still only accept it. Move it away when no VM needs it anymore and run rotate-keys again", file)
+		}
+
+		if !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Create an ed25519 key pair without a passphrase, the public key is saved in keyFile.pub
+func generateKeyPair(keyFile string) error {
+	if err := os.MkdirAll(path.Dir(keyFile), 0755); err != nil {
+		return err
+	}
+
+	// ssh-keygen asks before it overwrites anything
+	for _, file := range []string{keyFile, keyFile + ".pub"} {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	output, err := exec.Command("/usr/bin/ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", "lab-cli", "-f", keyFile).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ssh-keygen failed: %s\n%s", err, output)
+	}
+
+	return nil
+}
+
+// Replace the key pair with a new one on all running VMs. The new public key is
+// added with the old key, then the old key is removed by logging in with the new one.
+func rotateKeysCommand(config *Config) error {
+	if config.AnsiblePublicKeyFile == "" {
+		return errors.New("rotate-keys needs the public key in a file, set ansible_public_key_file in the config ('lab-cli keygen' creates a key pair)")
+	}
+
+	if err := checkNoOldKeys(config.AnsiblePrivateKeyPath, config.AnsiblePublicKeyFile); err != nil {
+		return err
+	}
+
+	oldKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(config.AnsiblePublicKey))
+	if err != nil {
+		return fmt.Errorf("could not parse the current public key: %s", err)
+	}
+
+	// Create a libvirt connection
+	conn, err := libvirt.NewConnect("qemu:///system")
+	if err != nil {
+		return err
+	}
+
+	domains, err := getAllDomains(conn)
+	if err != nil {
+		return err
+	}
+
+	type target struct {
+		name    string
+		address net.IP
+	}
+
+	var targets []target
+	var stopped []string
+	var broken []string
+
+	for _, domain := range domains {
+		summary, err := getDomainSummary(&domain)
+		if err != nil {
+			return err
+		}
+
+		// Without a known address the key can't be added, treat it like a stopped VM
+		if summary.Problem != "" {
+			broken = append(broken, summary.Name)
+			continue
+		}
+
+		active, err := domain.IsActive()
+		if err != nil {
+			return err
+		}
+
+		if active {
+			targets = append(targets, target{summary.Name, summary.Address})
+		} else {
+			stopped = append(stopped, summary.Name)
+		}
+	}
+
+	newKeyFile := config.AnsiblePrivateKeyPath + ".new"
+
+	if err := generateKeyPair(newKeyFile); err != nil {
+		return err
+	}
+
+	newPublicKey, err := os.ReadFile(newKeyFile + ".pub")
+	if err != nil {
+		return err
+	}
+
+	// Add the new key everywhere first, if one VM fails nothing has been removed yet
+	for _, t := range targets {
+		fmt.Printf("Adding the new key to '%s'\n", t.name)
+
+		err := runKeyScript(config.AnsiblePrivateKeyPath, t.address, addKeyScript, strings.TrimSpace(string(newPublicKey)))
+		if err != nil {
+			return fmt.Errorf("could not add the new key to '%s', the old key is still used: %s", t.name, err)
+		}
+	}
+
+	// Also proves that the new key works before the old one is gone
+	oldKeyMatch := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(oldKey)))
+
+	var failed []string
+
+	for _, t := range targets {
+		fmt.Printf("Removing the old key from '%s'\n", t.name)
+
+		if err := runKeyScript(newKeyFile, t.address, removeKeyScript, oldKeyMatch); err != nil {
+			fmt.Printf("Could not remove the old key from '%s': %s\n", t.name, err)
+			failed = append(failed, t.name)
+		}
+	}
+
+	// The public key file can be in another directory, and a rename can't move it there
+	newPublicKeyFile := config.AnsiblePublicKeyFile + ".new"
+	if err := os.WriteFile(newPublicKeyFile, newPublicKey, 0644); err != nil {
+		return err
+	}
+
+	// Keep the old key pair since stopped VMs still need it
+	files := []fileRename{
+		{config.AnsiblePrivateKeyPath, config.AnsiblePrivateKeyPath + ".old"},
+		{config.AnsiblePublicKeyFile, config.AnsiblePublicKeyFile + ".old"},
+		{newKeyFile, config.AnsiblePrivateKeyPath},
+		{newPublicKeyFile, config.AnsiblePublicKeyFile},
+	}
+
+	if err := renameFiles(files); err != nil {
+		return fmt.Errorf("could not replace the key pair, the old one is still in place: %s", err)
+	}
+
+	if err := os.Remove(newKeyFile + ".pub"); err != nil {
+		return err
+	}
+
+	fmt.Printf("\nThe new key pair is in %s, the old one has been moved to %s.old\n", config.AnsiblePrivateKeyPath, config.AnsiblePrivateKeyPath)
+
+	if len(failed) > 0 {
+		fmt.Printf("The old key could not be removed from: %s\n", strings.Join(failed, ", "))
+	}
+
+	if len(broken) > 0 {
+		fmt.Printf("These VMs are broken and only accept the old key, fix them with 'lab-cli repair': %s\n", strings.Join(broken, ", "))
+	}
+
+	if len(stopped) > 0 {
+		fmt.Printf("These VMs are not running and only accept the old key: %s\n", strings.Join(stopped, ", "))
+	}
+
+	return nil
+}
+
+type fileRename struct {
+	from string
+	to   string
+}
+
+// Rename all files or none of them, the renames that were done are undone if one fails
+func renameFiles(files []fileRename) error {
+	for i, file := range files {
+		if err := os.Rename(file.from, file.to); err != nil {
+			for j := i - 1; j >= 0; j-- {
+				os.Rename(files[j].to, files[j].from)
+			}
+
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Add the public key in $1 to authorized_keys unless it is already there
+const addKeyScript = `cd ~/.ssh && (grep -qxF "$1" authorized_keys || { chmod 600 authorized_keys && echo "$1" >> authorized_keys; }) && chmod 400 authorized_keys`
+
+// Remove every line that contains the key in $1 from authorized_keys
+const removeKeyScript = `cd ~/.ssh && grep -vF "$1" authorized_keys > authorized_keys.new; chmod 400 authorized_keys.new && mv -f authorized_keys.new authorized_keys`
+
+// Run one of the key scripts above as the ansible user, with key as the argument
+func runKeyScript(keyFile string, address net.IP, script string, key string) error {
+	// Only use keyFile, a key from the SSH agent would hide that the new key does not work
+	arguments := append([]string{"-o", "BatchMode=yes", "-o", "IdentitiesOnly=yes"}, sshKeyArguments(keyFile, address)...)
+	arguments = append(arguments, shellJoin([]string{"sh", "-c", script, "sh", key}))
+
+	output, err := exec.Command("/usr/bin/ssh", arguments...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s", err, strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
+
+func parseKeygen(args []string) (*KeygenOptions, error) {
+	command := flag.NewFlagSet("keygen", flag.ExitOnError)
+	force := command.Bool("force", false, "replace an existing key pair")
+
+	command.Parse(args[2:])
+
+	options := &KeygenOptions{
+		Force: *force,
+	}
+
+	return options, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func TestRenameFiles(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, name := range []string{"id", "id.pub", "id.new"} {
+		if err := os.WriteFile(path.Join(dir, name), []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// id.pub.new is missing so the last rename fails
+	files := []fileRename{
+		{path.Join(dir, "id"), path.Join(dir, "id.old")},
+		{path.Join(dir, "id.pub"), path.Join(dir, "id.pub.old")},
+		{path.Join(dir, "id.new"), path.Join(dir, "id")},
+		{path.Join(dir, "id.pub.new"), path.Join(dir, "id.pub")},
+	}
+
+	if err := renameFiles(files); err == nil {
+		t.Fatal("renaming a missing file didn't fail")
+	}
+
+	for _, name := range []string{"id", "id.pub", "id.new"} {
+		data, err := os.ReadFile(path.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(data) != name {
+			t.Errorf("got %q in %s, want %q", data, name, name)
+		}
+	}
+
+	for _, name := range []string{"id.old", "id.pub.old"} {
+		if _, err := os.Stat(path.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s was left behind", name)
+		}
+	}
+
+	if err := os.WriteFile(path.Join(dir, "id.pub.new"), []byte("id.pub.new"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := renameFiles(files); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]string{"id": "id.new", "id.pub": "id.pub.new", "id.old": "id", "id.pub.old": "id.pub"} {
+		if data, _ := os.ReadFile(path.Join(dir, name)); string(data) != want {
+			t.Errorf("got %q in %s, want %q", data, name, want)
+		}
+	}
+}
+
+func TestCheckNoOldKeys(t *testing.T) {
+	dir := t.TempDir()
+	privateKey := path.Join(dir, "id")
+	publicKey := path.Join(dir, "id.pub")
+
+	if err := checkNoOldKeys(privateKey, publicKey); err != nil {
+		t.Errorf("unexpected error without old keys: %s", err)
+	}
+
+	for _, name := range []string{"id.old", "id.pub.old"} {
+		file := path.Join(dir, name)
+		if err := os.WriteFile(file, []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := checkNoOldKeys(privateKey, publicKey); err == nil {
+			t.Errorf("expected an error when %s exists", name)
+		}
+
+		if err := os.Remove(file); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
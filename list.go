@@ -0,0 +1,597 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/yaml.v2"
+	libvirt "libvirt.org/libvirt-go"
+)
+
+type ListOptions struct {
+	Output  string
+	Columns []string
+	Filters map[string]string
+	Sort    string
+}
+
+// Everything we know about a VM, used by list
+type DomainDetails struct {
+	Name      string
+	State     string
+	Address   net.IP
+	Groups    []string
+	Distro    string
+	RAM       int
+	VCPUs     int
+	Disk      int
+	Uptime    time.Duration
+	CreatedAt *time.Time
+	// Set if the VM is broken, the state is then "broken"
+	Problem string
+}
+
+// Available columns in the order they are shown, and their table headers
+var listColumns = []string{"name", "state", "ip", "groups", "distro", "ram", "vcpus", "disk", "uptime", "created_at"}
+
+var listHeaders = map[string]string{
+	"name":       "Name",
+	"state":      "State",
+	"ip":         "IP Address",
+	"groups":     "Ansible groups",
+	"distro":     "Distro",
+	"ram":        "RAM (MiB)",
+	"vcpus":      "VCPUs",
+	"disk":       "Disk (GB)",
+	"uptime":     "Uptime",
+	"created_at": "Created",
+}
+
+var defaultListColumns = []string{"name", "state", "ip", "groups"}
+
+func listCommand(args []string) error {
+	// Parse arguments
+	options, err := parseList(args)
+	if err != nil {
+		return err
+	}
+
+	// Create a libvirt connection
+	conn, err := libvirt.NewConnect("qemu:///system")
+	if err != nil {
+		return err
+	}
+
+	domains, err := getAllDomains(conn)
+	if err != nil {
+		return err
+	}
+
+	// Without /proc the uptime is left out
+	startTimes, _ := qemuStartTimes()
+
+	var details []*DomainDetails
+
+	for _, domain := range domains {
+		detail, err := getDomainDetails(conn, &domain, startTimes)
+		if err != nil {
+			return err
+		}
+
+		if matchDomain(detail, options.Filters) {
+			details = append(details, detail)
+		}
+	}
+
+	sortDomains(details, options.Sort)
+
+	// On stderr so the output can still be parsed
+	defer func() {
+		for _, detail := range details {
+			if detail.Problem != "" {
+				fmt.Fprintf(os.Stderr, "Warning: '%s' is broken: %s. Fix it with 'lab-cli repair --ip <address> --groups <groups> %s'\n", detail.Name, detail.Problem, detail.Name)
+			}
+		}
+	}()
+
+	switch options.Output {
+	case "table":
+		writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, '\t', tabwriter.AlignRight)
+
+		var headers []string
+		for _, column := range options.Columns {
+			headers = append(headers, listHeaders[column])
+		}
+		fmt.Fprintln(writer, strings.Join(headers, "\t"))
+
+		for _, detail := range details {
+			var values []string
+			for _, column := range options.Columns {
+				values = append(values, detail.text(column))
+			}
+			fmt.Fprintln(writer, strings.Join(values, "\t"))
+		}
+
+		writer.Flush()
+	case "csv":
+		writer := csv.NewWriter(os.Stdout)
+		writer.Write(options.Columns)
+
+		for _, detail := range details {
+			var values []string
+			for _, column := range options.Columns {
+				values = append(values, detail.text(column))
+			}
+			writer.Write(values)
+		}
+
+		writer.Flush()
+		return writer.Error()
+	case "json":
+		output := []map[string]interface{}{}
+
+		for _, detail := range details {
+			values := make(map[string]interface{})
+			for _, column := range options.Columns {
+				values[column] = detail.value(column)
+			}
+			output = append(output, values)
+		}
+
+		data, err := json.MarshalIndent(output, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(string(data))
+	case "yaml":
+		output := []yaml.MapSlice{}
+
+		// MapSlice keeps the columns in the order they were requested
+		for _, detail := range details {
+			var values yaml.MapSlice
+			for _, column := range options.Columns {
+				values = append(values, yaml.MapItem{Key: column, Value: detail.value(column)})
+			}
+			output = append(output, values)
+		}
+
+		data, err := yaml.Marshal(output)
+		if err != nil {
+			return err
+		}
+
+		fmt.Print(string(data))
+	}
+
+	return nil
+}
+
+// startTimes is from qemuStartTimes, the uptime is left out for VMs that are missing from it
+func getDomainDetails(conn *libvirt.Connect, domain *libvirt.Domain, startTimes map[string]time.Time) (*DomainDetails, error) {
+	summary, err := getDomainSummary(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	state, _, err := domain.GetState()
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := domain.GetInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	metadata, metadataProblem, err := readDomainMetadata(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	// Add up the size of all disks. A volume that can't be found is skipped since
+	// it is not taking any space anyway.
+	disks, err := getDomainDisks(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	var diskSize uint64
+
+	for _, disk := range disks {
+		volume, err := conn.LookupStorageVolByPath(disk.Source.File)
+		if err != nil {
+			continue
+		}
+
+		volumeInfo, err := volume.GetInfo()
+		if err != nil {
+			return nil, err
+		}
+
+		diskSize += volumeInfo.Capacity
+	}
+
+	// The uptime is how long the qemu process has been running, no matter what started it
+	var uptime time.Duration
+
+	if started, exists := startTimes[summary.Name]; exists && state == libvirt.DOMAIN_RUNNING {
+		uptime = time.Since(started).Truncate(time.Second)
+	}
+
+	details := &DomainDetails{
+		Name:      summary.Name,
+		State:     domainStateName(state),
+		Address:   summary.Address,
+		Groups:    summary.Groups,
+		Distro:    metadata.Distro,
+		RAM:       int(info.Memory / 1024),
+		VCPUs:     int(info.NrVirtCpu),
+		Disk:      int(diskSize / 1024 / 1024 / 1024),
+		Uptime:    uptime,
+		CreatedAt: metadata.CreatedAt,
+		Problem:   joinProblems(summary.Problem, metadataProblem),
+	}
+
+	if details.Problem != "" {
+		details.State = "broken"
+	}
+
+	return details, nil
+}
+
+// A short name of the domain state without spaces so it is easy to filter on
+func domainStateName(state libvirt.DomainState) string {
+	switch state {
+	case libvirt.DOMAIN_RUNNING:
+		return "running"
+	case libvirt.DOMAIN_BLOCKED:
+		return "blocked"
+	case libvirt.DOMAIN_PAUSED:
+		return "paused"
+	case libvirt.DOMAIN_SHUTDOWN:
+		return "shutdown"
+	case libvirt.DOMAIN_SHUTOFF:
+		return "shutoff"
+	case libvirt.DOMAIN_CRASHED:
+		return "crashed"
+	case libvirt.DOMAIN_PMSUSPENDED:
+		return "suspended"
+	}
+
+	return "unknown"
+}
+
+// Value of a column as text, used by the table and csv output
+func (d *DomainDetails) text(column string) string {
+	switch column {
+	case "name":
+		return d.Name
+	case "state":
+		return d.State
+	case "ip":
+		if d.Address == nil {
+			return ""
+		}
+		return d.Address.String()
+	case "groups":
+		return strings.Join(d.Groups, ",")
+	case "distro":
+		return d.Distro
+	case "ram":
+		return strconv.Itoa(d.RAM)
+	case "vcpus":
+		return strconv.Itoa(d.VCPUs)
+	case "disk":
+		return strconv.Itoa(d.Disk)
+	case "uptime":
+		if d.Uptime == 0 {
+			return ""
+		}
+		return d.Uptime.String()
+	case "created_at":
+		if d.CreatedAt == nil {
+			return ""
+		}
+		return d.CreatedAt.Format(time.RFC3339)
+	}
+
+	return ""
+}
+
+// Value of a column with its proper type, used by the json and yaml output
+func (d *DomainDetails) value(column string) interface{} {
+	switch column {
+	case "groups":
+		return d.Groups
+	case "ram":
+		return d.RAM
+	case "vcpus":
+		return d.VCPUs
+	case "disk":
+		return d.Disk
+	case "uptime":
+		if d.Uptime == 0 {
+			return nil
+		}
+		return int64(d.Uptime.Seconds())
+	case "created_at":
+		if d.CreatedAt == nil {
+			return nil
+		}
+	}
+
+	return d.text(column)
+}
+
+// Check if a VM matches all filters. The group filter matches if the VM is
+// a member of the group, everything else has to match the column text exactly.
+func matchDomain(d *DomainDetails, filters map[string]string) bool {
+	for key, value := range filters {
+		if key == "group" || key == "groups" {
+			member := false
+
+			for _, group := range d.Groups {
+				if group == value {
+					member = true
+				}
+			}
+
+			if !member {
+				return false
+			}
+		} else if d.text(key) != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Sort VMs by a column, a "-" prefix reverses the order
+func sortDomains(details []*DomainDetails, column string) {
+	reverse := strings.HasPrefix(column, "-")
+	column = strings.TrimPrefix(column, "-")
+
+	less := func(a, b *DomainDetails) bool {
+		switch column {
+		case "ip":
+			return bytes.Compare(a.Address.To16(), b.Address.To16()) < 0
+		case "ram":
+			return a.RAM < b.RAM
+		case "vcpus":
+			return a.VCPUs < b.VCPUs
+		case "disk":
+			return a.Disk < b.Disk
+		case "uptime":
+			return a.Uptime < b.Uptime
+		case "created_at":
+			if a.CreatedAt == nil || b.CreatedAt == nil {
+				return a.CreatedAt == nil && b.CreatedAt != nil
+			}
+			return a.CreatedAt.Before(*b.CreatedAt)
+		}
+
+		return a.text(column) < b.text(column)
+	}
+
+	sort.SliceStable(details, func(i, j int) bool {
+		if reverse {
+			return less(details[j], details[i])
+		}
+		return less(details[i], details[j])
+	})
+}
+
+func isListColumn(column string) bool {
+	for _, c := range listColumns {
+		if c == column {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parseList(args []string) (*ListOptions, error) {
+	var columns GroupFlag
+	var filters GroupFlag
+	command := flag.NewFlagSet("list", flag.ExitOnError)
+	output := command.String("output", "table", "output format: table, json, yaml or csv")
+	sortBy := command.String("sort", "name", "column to sort by, prefix with - to reverse")
+	command.Var(&columns, "columns", fmt.Sprintf("columns to show: %s", strings.Join(listColumns, ", ")))
+	command.Var(&filters, "filter", "only show VMs matching column=value, e.g. group=web,state=running")
+
+	command.Parse(args[2:])
+
+	if *output != "table" && *output != "json" && *output != "yaml" && *output != "csv" {
+		return nil, fmt.Errorf("'%s' is not a valid output format", *output)
+	}
+
+	if len(columns) < 1 {
+		columns = defaultListColumns
+	}
+
+	for _, column := range columns {
+		if !isListColumn(column) {
+			return nil, fmt.Errorf("'%s' is not a valid column", column)
+		}
+	}
+
+	if !isListColumn(strings.TrimPrefix(*sortBy, "-")) {
+		return nil, fmt.Errorf("can not sort by '%s'", *sortBy)
+	}
+
+	filterMap := make(map[string]string)
+
+	for _, filter := range filters {
+		filterSplit := strings.SplitN(filter, "=", 2)
+		if len(filterSplit) != 2 {
+			return nil, fmt.Errorf("'%s' is not a valid filter, use column=value", filter)
+		}
+
+		key := filterSplit[0]
+		if key != "group" && !isListColumn(key) {
+			return nil, fmt.Errorf("can not filter on '%s'", key)
+		}
+
+		filterMap[key] = filterSplit[1]
+	}
+
+	options := &ListOptions{
+		Output:  *output,
+		Columns: columns,
+		Filters: filterMap,
+		Sort:    *sortBy,
+	}
+
+	return options, nil
+}
+
+// Clock ticks per second in /proc, the same on every Linux architecture
+const procClockTicks = 100
+
+// When the qemu process of each running VM was started, by the name of the VM. Processes
+// that exit while they are read are skipped.
+func qemuStartTimes() (map[string]time.Time, error) {
+	stat, err := ioutil.ReadFile("/proc/stat")
+	if err != nil {
+		return nil, err
+	}
+
+	bootTime, err := procBootTime(string(stat))
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	startTimes := make(map[string]time.Time)
+
+	for _, entry := range entries {
+		if _, err := strconv.Atoi(entry.Name()); err != nil {
+			continue
+		}
+
+		cmdline, err := ioutil.ReadFile(path.Join("/proc", entry.Name(), "cmdline"))
+		if err != nil {
+			continue
+		}
+
+		name := qemuGuestName(strings.Split(strings.TrimRight(string(cmdline), "\x00"), "\x00"))
+		if name == "" {
+			continue
+		}
+
+		processStat, err := ioutil.ReadFile(path.Join("/proc", entry.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+
+		ticks, err := processStartTicks(string(processStat))
+		if err != nil {
+			continue
+		}
+
+		startTimes[name] = bootTime.Add(time.Duration(ticks) * time.Second / procClockTicks)
+	}
+
+	return startTimes, nil
+}
+
+// The btime line of /proc/stat
+func procBootTime(stat string) (time.Time, error) {
+	for _, line := range strings.Split(stat, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "btime" {
+			seconds, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return time.Time{}, err
+			}
+
+			return time.Unix(seconds, 0), nil
+		}
+	}
+
+	return time.Time{}, errors.New("the boot time is missing from /proc/stat")
+}
+
+// The start time of a process in clock ticks after boot, the 22nd field of /proc/<pid>/stat.
+// The command name in the second field can contain spaces so the fields are counted after it.
+func processStartTicks(stat string) (uint64, error) {
+	end := strings.LastIndex(stat, ")")
+	if end == -1 {
+		return 0, errors.New("the command name is missing")
+	}
+
+	fields := strings.Fields(stat[end+1:])
+	if len(fields) < 20 {
+		return 0, fmt.Errorf("expected at least 22 fields, got %d", len(fields)+2)
+	}
+
+	return strconv.ParseUint(fields[19], 10, 64)
+}
+
+// The name of the VM that a qemu command line runs, from -name guest=<name>,... or the
+// older -name <name>. Commas in the name are doubled. Empty for any other command.
+func qemuGuestName(args []string) string {
+	if len(args) == 0 || !strings.Contains(path.Base(args[0]), "qemu") {
+		return ""
+	}
+
+	for i := 0; i < len(args)-1; i++ {
+		if args[i] != "-name" {
+			continue
+		}
+
+		// Split on the commas that are not doubled
+		var options []string
+		var option strings.Builder
+		value := args[i+1]
+
+		for j := 0; j < len(value); j++ {
+			if value[j] == ',' {
+				if j+1 < len(value) && value[j+1] == ',' {
+					option.WriteByte(',')
+					j++
+					continue
+				}
+
+				options = append(options, option.String())
+				option.Reset()
+				continue
+			}
+
+			option.WriteByte(value[j])
+		}
+		options = append(options, option.String())
+
+		for j, option := range options {
+			if strings.HasPrefix(option, "guest=") {
+				return strings.TrimPrefix(option, "guest=")
+			}
+
+			if j == 0 && !strings.Contains(option, "=") {
+				return option
+			}
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFilterAndSortDomains(t *testing.T) {
+	domains := []*DomainDetails{
+		{Name: "web02", State: "running", Address: net.ParseIP("192.168.100.12"), Groups: []string{"web"}, RAM: 2048},
+		{Name: "db01", State: "running", Address: net.ParseIP("192.168.100.9"), Groups: []string{"db"}, RAM: 4096},
+		{Name: "web01", State: "shutoff", Address: net.ParseIP("192.168.100.100"), Groups: []string{"web", "dmz"}, RAM: 1024},
+	}
+
+	filters := map[string]string{"group": "web", "state": "running"}
+
+	var matched []string
+	for _, domain := range domains {
+		if matchDomain(domain, filters) {
+			matched = append(matched, domain.Name)
+		}
+	}
+
+	if len(matched) != 1 || matched[0] != "web02" {
+		t.Errorf("did not match the VMs we wanted. got: %v, want: [web02]", matched)
+	}
+
+	var tests = []struct {
+		column string
+		want   []string
+	}{
+		{"name", []string{"db01", "web01", "web02"}},
+		{"-ram", []string{"db01", "web02", "web01"}},
+		{"ip", []string{"db01", "web02", "web01"}},
+	}
+
+	for _, test := range tests {
+		sortDomains(domains, test.column)
+
+		for i, domain := range domains {
+			if domain.Name != test.want[i] {
+				t.Errorf("wrong order sorting by %s. got: %s at %d, want: %s", test.column, domain.Name, i, test.want[i])
+			}
+		}
+	}
+}
+
+func TestQemuGuestName(t *testing.T) {
+	var tests = []struct {
+		args []string
+		want string
+	}{
+		{[]string{"/usr/bin/qemu-system-x86_64", "-name", "guest=web01,debug-threads=on", "-S"}, "web01"},
+		{[]string{"/usr/libexec/qemu-kvm", "-name", "guest=odd,,name,debug-threads=on"}, "odd,name"},
+		{[]string{"qemu-kvm", "-name", "db01", "-m", "1024"}, "db01"},
+		{[]string{"qemu-kvm", "-m", "1024"}, ""},
+		{[]string{"/usr/bin/vim", "-name", "guest=web01"}, ""},
+		{nil, ""},
+	}
+
+	for _, test := range tests {
+		if got := qemuGuestName(test.args); got != test.want {
+			t.Errorf("did not get the name we wanted for %v. got: %q, want: %q", test.args, got, test.want)
+		}
+	}
+}
+
+func TestProcessStartTicks(t *testing.T) {
+	stat := "4242 (qemu-system-x86) S 1 4241 4241 0 -1 138412416 146211 0 0 0 5213 2831 0 0 20 0 5 0 987654 3963199488 270845 18446744073709551615"
+
+	ticks, err := processStartTicks(stat)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if ticks != 987654 {
+		t.Errorf("did not get the start time we wanted. got: %d, want: 987654", ticks)
+	}
+
+	// A command name with spaces and parentheses
+	ticks, err = processStartTicks("4242 (a (b) c) S 1 4241 4241 0 -1 138412416 146211 0 0 0 5213 2831 0 0 20 0 5 0 1234 3963199488")
+	if err != nil || ticks != 1234 {
+		t.Errorf("did not get the start time we wanted. got: %d (%v), want: 1234", ticks, err)
+	}
+
+	if _, err := processStartTicks("4242 (qemu) S 1"); err == nil {
+		t.Errorf("expected an error for a short stat line")
+	}
+}
+
+func TestProcBootTime(t *testing.T) {
+	bootTime, err := procBootTime("cpu  1 2 3 4\nintr 5\nbtime 1614600000\nprocesses 42\n")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if !bootTime.Equal(time.Unix(1614600000, 0)) {
+		t.Errorf("did not get the boot time we wanted. got: %s", bootTime)
+	}
+
+	if _, err := procBootTime("cpu  1 2 3 4\n"); err == nil {
+		t.Errorf("expected an error when btime is missing")
+	}
+}
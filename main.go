@@ -16,10 +16,12 @@
 package main
 
 import (
+	"bytes"
 	"encoding/xml"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"os"
@@ -27,10 +29,10 @@ import (
 	"os/user"
 	"path"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
-	"text/tabwriter"
-	"text/template"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	libvirt "libvirt.org/libvirt-go"
@@ -46,17 +48,47 @@ type NetworkConfig struct {
 	RangeEnd   net.IP `toml:"range_end"`
 }
 
+type PXEConfig struct {
+	Enabled  bool   `toml:"enabled"`
+	TFTPRoot string `toml:"tftp_root"`
+}
+
 type DistroConfig struct {
-	Location string `toml:"location"`
+	Location   string   `toml:"location"`
+	MirrorHost string   `toml:"mirror_host"`
+	MirrorPath string   `toml:"mirror_path"`
+	KernelArgs []string `toml:"kernel_args"`
+}
+
+// Settings for the installer that are passed to the templates
+type InstallConfig struct {
+	Locale      string            `toml:"locale"`
+	Keyboard    string            `toml:"keyboard"`
+	Timezone    string            `toml:"timezone"`
+	HTTPProxy   string            `toml:"http_proxy"`
+	Nameservers []string          `toml:"nameservers"`
+	Packages    []string          `toml:"packages"`
+	Vars        map[string]string `toml:"vars"`
 }
 
 type Config struct {
-	VirtInstallPath       string        `toml:"virt_install_path"`
-	AnsiblePublicKey      string        `toml:"ansible_public_key"`
-	AnsiblePrivateKeyPath string        `toml:"ansible_private_key_path"`
-	Network               NetworkConfig `toml:"network"`
-	Debian                DistroConfig  `toml:"debian"`
-	Centos                DistroConfig  `toml:"centos"`
+	VirtInstallPath        string        `toml:"virt_install_path"`
+	VirtClonePath          string        `toml:"virt_clone_path"`
+	VirtCustomizePath      string        `toml:"virt_customize_path"`
+	AnsiblePublicKey       string        `toml:"ansible_public_key"`
+	AnsiblePublicKeyFile   string        `toml:"ansible_public_key_file"`
+	AnsiblePrivateKeyPath  string        `toml:"ansible_private_key_path"`
+	RootPassword           string        `toml:"root_password"`
+	ServeConfig            bool          `toml:"serve_config"`
+	ServePort              int           `toml:"serve_port"`
+	StoragePool            string        `toml:"storage_pool"`
+	AnsibleConsolePassword bool          `toml:"ansible_console_password"`
+	Install                InstallConfig `toml:"install"`
+	Network                NetworkConfig `toml:"network"`
+	PXE                    PXEConfig     `toml:"pxe"`
+	Debian                 DistroConfig  `toml:"debian"`
+	Centos                 DistroConfig  `toml:"centos"`
+	Ubuntu                 DistroConfig  `toml:"ubuntu"`
 }
 
 type GeneralOptions struct {
@@ -69,7 +101,32 @@ type CreateOptions struct {
 	RAM    int
 	VCPUs  int
 	Disk   int
-	Groups []string
+	// Empty means the default of virt-install
+	DiskFormat string
+	DiskBus    string
+	ExtraDisks []ExtraDisk
+	Groups     []string
+	Vars       map[string]string
+	Console    bool
+	NoWait     bool
+	DryRun     bool
+	Serve      bool
+	// Appended to the kernel command line and the virt-install arguments
+	KernelArgs      []string
+	VirtInstallArgs []string
+	// Installing from an ISO image in the storage pool
+	LocalMedia bool
+	// Overrides the install settings from the config
+	Install    InstallConfig
+	MirrorHost string
+	MirrorPath string
+	// Address can be given with --ip, rebuild sets all of them so the VM keeps its
+	// identity. Otherwise they are new.
+	Address net.IP
+	MAC     string
+	Secrets *Secrets
+	// Set by rebuild to the kernel arguments the config had, nil takes them from the config
+	ConfigKernelArgs []string
 }
 
 type NetworkBridge struct {
@@ -77,8 +134,10 @@ type NetworkBridge struct {
 }
 
 type NetworkIP struct {
-	Address net.IP `xml:"address,attr"`
-	Netmask net.IP `xml:"netmask,attr"`
+	Address net.IP       `xml:"address,attr"`
+	Netmask net.IP       `xml:"netmask,attr"`
+	TFTP    *NetworkTFTP `xml:"tftp,omitempty"`
+	DHCP    *NetworkDHCP `xml:"dhcp,omitempty"`
 }
 
 type NetworkXML struct {
@@ -86,6 +145,7 @@ type NetworkXML struct {
 	Name    string        `xml:"name"`
 	Forward string        `xml:"forward"`
 	Bridge  NetworkBridge `xml:"bridge"`
+	DNS     *NetworkDNS   `xml:"dns,omitempty"`
 	IP      NetworkIP     `xml:"ip"`
 }
 
@@ -94,14 +154,53 @@ type DomainSummary struct {
 	Address net.IP
 	Groups  []string
 	Status  bool
+	// Why the description could not be parsed. Address is then only a guess, or nil.
+	Problem string
+}
+
+type DomainDisk struct {
+	Device string `xml:"device,attr"`
+	Driver struct {
+		Type string `xml:"type,attr"`
+	} `xml:"driver"`
+	Source struct {
+		File string `xml:"file,attr"`
+	} `xml:"source"`
+	Target struct {
+		Dev string `xml:"dev,attr"`
+	} `xml:"target"`
+	BackingStore *DiskBackingStore `xml:"backingStore"`
+	Serial       string            `xml:"serial"`
+}
+
+// The image a disk is an overlay on, like after an external snapshot. The chain ends
+// with an empty backingStore element.
+type DiskBackingStore struct {
+	Source struct {
+		File string `xml:"file,attr"`
+	} `xml:"source"`
+	BackingStore *DiskBackingStore `xml:"backingStore"`
 }
 
 type GroupFlag []string
 
+type VarFlag map[string]string
+
+// Can be repeated, unlike GroupFlag the values are not split on commas
+type ArgFlag []string
+
 var defaultConfig = Config{
 	VirtInstallPath:       "/usr/bin/virt-install",
+	VirtClonePath:         "/usr/bin/virt-clone",
+	VirtCustomizePath:     "/usr/bin/virt-customize",
 	AnsiblePublicKey:      "",
 	AnsiblePrivateKeyPath: "~/.ssh/labcli_private",
+	StoragePool:           defaultStoragePool,
+	Install: InstallConfig{
+		Locale:   "en_US.UTF-8",
+		Keyboard: "se",
+		Timezone: "Europe/Stockholm",
+	},
 	Network: NetworkConfig{
 		Name:       "labnet",
 		Domain:     "lab.local",
@@ -111,14 +210,29 @@ var defaultConfig = Config{
 		RangeStart: net.ParseIP("192.168.100.10"),
 		RangeEnd:   net.ParseIP("192.168.100.200"),
 	},
+	PXE: PXEConfig{
+		TFTPRoot: "/var/lib/lab-cli/tftp",
+	},
 	Debian: DistroConfig{
-		Location: "http://ftp.se.debian.org/debian/dists/buster/main/installer-amd64/",
+		Location:   "http://ftp.se.debian.org/debian/dists/buster/main/installer-amd64/",
+		MirrorHost: "ftp.se.debian.org",
+		MirrorPath: "/debian",
 	},
 	Centos: DistroConfig{
-		Location: "http://mirror.nsc.liu.se/CentOS/8/BaseOS/x86_64/kickstart/",
+		Location:   "http://mirror.nsc.liu.se/CentOS/8/BaseOS/x86_64/kickstart/",
+		MirrorHost: "ftp.lysator.liu.se",
+		MirrorPath: "/pub/CentOS/8/BaseOS/x86_64/os/",
+	},
+	Ubuntu: DistroConfig{
+		Location:   "/var/lib/libvirt/images/ubuntu-22.04.3-live-server-amd64.iso",
+		MirrorHost: "se.archive.ubuntu.com",
+		MirrorPath: "/ubuntu",
 	},
 }
 
+// Distributions that can be installed
+var distros = []string{"debian", "centos", "ubuntu"}
+
 func main() {
 	if len(os.Args) < 2 {
 		exitError(errors.New("you must specify a subcommand"))
@@ -144,13 +258,18 @@ func main() {
 		if err != nil {
 			exitError(err)
 		}
+	case "render":
+		err := renderCommand(os.Args, config)
+		if err != nil {
+			exitError(err)
+		}
 	case "remove":
-		err := removeCommand(os.Args)
+		err := removeCommand(os.Args, config)
 		if err != nil {
 			exitError(err)
 		}
 	case "list":
-		err := listCommand()
+		err := listCommand(os.Args)
 		if err != nil {
 			exitError(err)
 		}
@@ -169,6 +288,86 @@ func main() {
 		if err != nil {
 			exitError(err)
 		}
+	case "info":
+		err := infoCommand(os.Args, config)
+		if err != nil {
+			exitError(err)
+		}
+	case "console":
+		err := consoleCommand(os.Args)
+		if err != nil {
+			exitError(err)
+		}
+	case "logs":
+		err := logsCommand(os.Args)
+		if err != nil {
+			exitError(err)
+		}
+	case "config":
+		err := configCommand(os.Args, config)
+		if err != nil {
+			exitError(err)
+		}
+	case "secret":
+		err := secretCommand(os.Args)
+		if err != nil {
+			exitError(err)
+		}
+	case "keygen":
+		err := keygenCommand(os.Args)
+		if err != nil {
+			exitError(err)
+		}
+	case "rotate-keys":
+		err := rotateKeysCommand(config)
+		if err != nil {
+			exitError(err)
+		}
+	case "media":
+		err := mediaCommand(os.Args, config)
+		if err != nil {
+			exitError(err)
+		}
+	case "doctor":
+		err := doctorCommand(config)
+		if err != nil {
+			exitError(err)
+		}
+	case "repair":
+		err := repairCommand(os.Args, config)
+		if err != nil {
+			exitError(err)
+		}
+	case "rebuild":
+		err := rebuildCommand(os.Args, config)
+		if err != nil {
+			exitError(err)
+		}
+	case "clone":
+		err := cloneCommand(os.Args, config)
+		if err != nil {
+			exitError(err)
+		}
+	case "adopt":
+		err := adoptCommand(os.Args, config)
+		if err != nil {
+			exitError(err)
+		}
+	case "forget":
+		err := forgetCommand(os.Args)
+		if err != nil {
+			exitError(err)
+		}
+	case "gc":
+		err := gcCommand(os.Args, config)
+		if err != nil {
+			exitError(err)
+		}
+	case "resize":
+		err := resizeCommand(os.Args, config)
+		if err != nil {
+			exitError(err)
+		}
 	default:
 		exitError(fmt.Errorf("'%s' is not a valid subcommand", os.Args[1]))
 	}
@@ -181,12 +380,102 @@ func createCommand(args []string, config *Config) error {
 		return err
 	}
 
+	return createVM(config, options)
+}
+
+// Check everything create needs before anything is created: the config, the storage pool,
+// the install media and the install config. It also decides how the installer gets its
+// config. rebuild runs it before the old VM is removed, it can be run more than once.
+func prepareCreate(conn *libvirt.Connect, config *Config, options *CreateOptions) (*Media, error) {
+	if config.ServeConfig {
+		options.Serve = true
+	}
+
+	// The installer fetches its config over HTTP when it is booted from the network
+	if config.PXE.Enabled {
+		if err := validatePXE(config, options.Distro); err != nil {
+			return nil, err
+		}
+
+		options.Serve = true
+	}
+
+	// Catch configuration problems before anything is created
+	if problems := validateConfig(config); len(problems) > 0 {
+		return nil, configProblemsError(problems)
+	}
+
+	if !options.DryRun {
+		pool, err := conn.LookupStoragePoolByName(config.StoragePool)
+		if err != nil {
+			return nil, err
+		}
+		defer pool.Free()
+
+		active, err := pool.IsActive()
+		if err != nil {
+			return nil, err
+		}
+
+		if !active {
+			return nil, fmt.Errorf("the storage pool '%s' is not running", config.StoragePool)
+		}
+	}
+
+	// Install from imported media if there is any, otherwise from the location in the config.
+	// PXE installs always download the installer.
+	var media *Media
+	if !config.PXE.Enabled {
+		var err error
+		media, err = getCachedMedia(conn, options.Distro)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if media != nil {
+		options.LocalMedia = media.Type == "iso"
+
+		// The install config can only be injected into an initrd that virt-install fetches itself
+		if media.Type == "kernel" {
+			options.Serve = true
+		}
+	}
+
+	// Render the install config once to find problems in the template, the real one
+	// is rendered later with the address and passwords of the VM
+	secrets := options.Secrets
+	if secrets == nil {
+		secrets = &Secrets{RootPassword: "check"}
+	}
+
+	address := options.Address
+	if address == nil {
+		address = config.Network.RangeStart
+	}
+
+	if err := executeTemplate(ioutil.Discard, config, options, address, secrets); err != nil {
+		return nil, fmt.Errorf("the install config can't be rendered: %s", err)
+	}
+
+	return media, nil
+}
+
+// Create and install a VM, used by create and rebuild
+func createVM(config *Config, options *CreateOptions) error {
+	var err error
+
 	// Create a libvirt connection
 	conn, err := libvirt.NewConnect("qemu:///system")
 	if err != nil {
 		return err
 	}
 
+	media, err := prepareCreate(conn, config, options)
+	if err != nil {
+		return err
+	}
+
 	// Check if a VM with the same name already exists
 	domain, err := getDomain(conn, options.Name)
 	if domain != nil {
@@ -200,46 +489,112 @@ func createCommand(args []string, config *Config) error {
 		}
 	}
 
-	// Create or get existing network
-	network, err := getNetwork(conn, config)
-	if err != nil {
-		// Create the network if it does not exist
-		if strings.Contains(err.Error(), "Network not found") {
-			network, err = createNetwork(conn, config)
-			if err != nil {
+	// Everything that is created from here on is removed again if create fails or is interrupted
+	tx := newRollback("create")
+	defer tx.Close()
+
+	// A dry run should not change anything
+	if !options.DryRun {
+		// Create or get existing network
+		created := false
+		network, err := getNetwork(conn, config)
+		if err != nil {
+			// Create the network if it does not exist
+			if strings.Contains(err.Error(), "Network not found") {
+				network, err = createNetwork(conn, config)
+				if err != nil {
+					return err
+				}
+
+				created = true
+				tx.Add(fmt.Sprintf("remove the network '%s'", config.Network.Name), func() error {
+					return removeNetwork(network)
+				})
+			} else {
 				return err
 			}
-		} else {
-			return err
 		}
-	}
 
-	// Make sure the network is running
-	err = startNetwork(conn, network)
-	if err != nil {
-		return err
+		active, err := statusNetwork(conn, network)
+		if err != nil {
+			return tx.Fail(err)
+		}
+
+		// Make sure the network is running
+		err = startNetwork(conn, network)
+		if err != nil {
+			return tx.Fail(err)
+		}
+
+		if !active && !created {
+			tx.Add(fmt.Sprintf("stop the network '%s'", config.Network.Name), network.Destroy)
+		}
+
+		if config.PXE.Enabled {
+			if err := checkPXENetwork(network, config); err != nil {
+				return tx.Fail(err)
+			}
+		}
 	}
 
-	// Find next available IP address
-	addr, err := nextAvailableAddress(conn, config)
-	if err != nil {
-		return err
+	// Find next available IP address, unless one was given or the VM is rebuilt and keeps its address
+	addr := options.Address
+	if addr != nil {
+		if err := checkAddressUnused(conn, options.Name, addr); err != nil {
+			return tx.Fail(err)
+		}
+	} else {
+		addr, err = nextAvailableAddress(conn, config)
+		if err != nil {
+			return tx.Fail(err)
+		}
 	}
 
 	// Create a temporary directory where we will save our parsed template file
 	outDir, err := ioutil.TempDir("", "")
 	if err != nil {
-		return err
+		return tx.Fail(err)
 	}
 	defer os.RemoveAll(outDir)
 
+	if media != nil {
+		fmt.Printf("Installing from the imported media (%s)\n", strings.Join(media.Sources, ", "))
+	}
+
+	// Passwords for root (and maybe the ansible user) on the new VM
+	secrets := options.Secrets
+	if secrets == nil {
+		secrets, err = newSecrets(config)
+		if err != nil {
+			return tx.Fail(err)
+		}
+	}
+
 	// Render file from our template into our temporary directory
-	outFile, err := renderTemplate(config, options, outDir, addr)
+	outFile, err := renderTemplate(config, options, outDir, addr, secrets)
 	if err != nil {
-		return err
+		return tx.Fail(err)
+	}
+
+	// The Ubuntu installer reads its config from a NoCloud seed with both user-data and meta-data
+	var metaFile string
+	if options.Distro == "ubuntu" {
+		metaFile, err = writeMetaData(options, outDir)
+		if err != nil {
+			return tx.Fail(err)
+		}
 	}
 
-	description := fmt.Sprintf("description=labcli:%s:%s", addr, strings.Join(options.Groups, ","))
+	// Known before the VM exists so it can get a DHCP host entry for PXE
+	mac := options.MAC
+	if mac == "" {
+		mac, err = randomMAC()
+		if err != nil {
+			return tx.Fail(err)
+		}
+	}
+
+	description := "description=" + formatDescription(addr, options.Groups)
 
 	// Prepare arguments for virt-install
 	// Maybe we can do this without virt-install in the future
@@ -248,152 +603,329 @@ func createCommand(args []string, config *Config) error {
 		"--name", options.Name,
 		"--ram", strconv.Itoa(options.RAM),
 		"--vcpus", strconv.Itoa(options.VCPUs),
-		"--disk", fmt.Sprintf("size=%s", strconv.Itoa(options.Disk)),
-		"--network", fmt.Sprintf("network=%s", config.Network.Name),
+		"--network", fmt.Sprintf("network=%s,mac=%s", config.Network.Name, mac),
 		"--metadata", description,
+		"--console", "pty,target_type=serial",
 		"--noautoconsole",
-		"--initrd-inject", outFile,
 	}
 
+	// The disks are added to the arguments once their volumes exist
+	volumes := diskVolumes(options)
+
+	// Serve the install config over HTTP on the gateway address instead of putting it in the initrd
+	var server *configServer
+	serverURL := fmt.Sprintf("http://%s:%d/<token>/", config.Network.Address, config.ServePort)
+
+	if options.Serve && !options.DryRun {
+		files, err := serveFiles(outFile, metaFile)
+		if err != nil {
+			return tx.Fail(err)
+		}
+
+		server, err = startConfigServer(config.Network.Address, config.ServePort, files)
+		if err != nil {
+			return tx.Fail(err)
+		}
+		defer server.Close()
+
+		serverURL = server.URL()
+	}
+
+	// Send kernel and installer output to the serial console as well. The last
+	// console is where the installer runs, so it can be followed with the console subcommand.
+	consoleArgs := "console=tty0 console=ttyS0,115200n8"
+
+	configKernelArgs := options.ConfigKernelArgs
+	if configKernelArgs == nil {
+		configKernelArgs = getDistroConfig(config, options.Distro).KernelArgs
+	}
+
+	// Kernel arguments from the config and create come last so they can override ours
+	extraArgs := append([]string{consoleArgs}, configKernelArgs...)
+	extraArgs = append(extraArgs, options.KernelArgs...)
+	kernelArgs := strings.Join(extraArgs, " ")
+
 	// Add extra arguments based on distro selection
-	if options.Distro == "debian" {
+	if config.PXE.Enabled {
+		arguments = append(arguments, "--pxe")
+	} else if options.Serve {
+		arguments = append(
+			arguments,
+			"--extra-args", fmt.Sprintf("%s %s", serveKernelArgs(config, options, addr, serverURL), kernelArgs),
+		)
+	} else if options.Distro == "debian" {
 		arguments = append(
 			arguments,
-			"--extra-args", "auto",
-			"--location", config.Debian.Location,
+			"--initrd-inject", outFile,
+			"--extra-args", fmt.Sprintf("auto %s", kernelArgs),
 		)
 	} else if options.Distro == "centos" {
 		arguments = append(
 			arguments,
-			"--extra-args", fmt.Sprintf("inst.ks=file:/%s", filepath.Base(outFile)),
-			"--location", config.Centos.Location,
+			"--initrd-inject", outFile,
+			"--extra-args", fmt.Sprintf("inst.ks=file:/%s %s", filepath.Base(outFile), kernelArgs),
+		)
+	} else if options.Distro == "ubuntu" {
+		// virt-install puts the seed on a CD-ROM with the label cidata, and the
+		// live-server ISO only starts an unattended install with the autoinstall argument
+		arguments = append(
+			arguments,
+			"--cloud-init", fmt.Sprintf("user-data=%s,meta-data=%s", outFile, metaFile),
+			"--extra-args", fmt.Sprintf("autoinstall ds=nocloud %s", kernelArgs),
 		)
 	}
 
-	// Run virt-install with our arguments, combine stdout/stderr
-	// Make the output a little bit better in the future, we don't need to print everything from virt-install
-	output, err := exec.Command(config.VirtInstallPath, arguments...).CombinedOutput()
-	if err != nil {
-		return err
+	if !config.PXE.Enabled {
+		arguments = append(arguments, installSourceArgs(config, options.Distro, media)...)
 	}
 
-	fmt.Println(string(output))
+	// Options that lab-cli does not know about are passed on as they are
+	arguments = append(arguments, options.VirtInstallArgs...)
 
-	fmt.Printf("\n'%s' is hopefully being installed right now. After the installation is finished the VM will shut down and you have to start it manually.\n", options.Name)
+	// Extra information about the VM that virt-install can not set for us
+	now := time.Now()
+	metadata := &DomainMetadata{
+		Distro:    options.Distro,
+		CreatedAt: &now,
+		Vars:      sortedVars(options.Vars),
+		// The ones from the config are saved separately, create only adds its own to KernelArgs
+		KernelArgs:       options.KernelArgs,
+		ConfigKernelArgs: configKernelArgs,
+		VirtInstallArgs:  options.VirtInstallArgs,
+		DiskFormat:       options.DiskFormat,
+		DiskBus:          options.DiskBus,
+		ExtraDisks:       options.ExtraDisks,
+		Disk:             options.Disk,
+		Install:          installMetadata(options),
+	}
 
-	return nil
-}
+	if options.DryRun {
+		metadataXML, err := xml.MarshalIndent(metadata, "", "  ")
+		if err != nil {
+			return tx.Fail(err)
+		}
 
-func removeCommand(args []string) error {
-	// Parse arguments
-	options, err := parseGeneral(args, "remove")
-	if err != nil {
-		return err
+		poolPath, err := getPoolPath(conn, config.StoragePool)
+		if err != nil {
+			return tx.Fail(err)
+		}
+
+		for i := range volumes {
+			if volumes[i].Path == "" {
+				volumes[i].Path = path.Join(poolPath, volumes[i].Name)
+			}
+		}
+
+		arguments = append(arguments, diskArguments(options, volumes)...)
+
+		fmt.Printf("IP address: %s\n\n", addr)
+		fmt.Printf("Description: %s\n\n", strings.TrimPrefix(description, "description="))
+		fmt.Printf("Metadata:\n%s\n\n", metadataXML)
+		fmt.Printf("virt-install command:\n%s\n\n", shellJoin(append([]string{config.VirtInstallPath}, arguments...)))
+		fmt.Printf("The rendered install config can be shown with 'lab-cli render --distro %s %s'\n", options.Distro, options.Name)
+
+		return nil
 	}
 
-	// Create a libvirt connection
-	conn, err := libvirt.NewConnect("qemu:///system")
+	// Save the passwords before the VM exists so they are never lost
+	err = storeSecrets(options.Name, secrets)
 	if err != nil {
-		return err
+		return tx.Fail(err)
 	}
 
-	// Check if the VM exists
-	domain, err := getDomain(conn, options.Name)
+	// Passwords that were given to us belong to someone else, like the VM that is rebuilt
+	if options.Secrets == nil {
+		tx.Add(fmt.Sprintf("remove the passwords of '%s'", options.Name), func() error {
+			return storeSecrets(options.Name, nil)
+		})
+	}
+
+	if config.PXE.Enabled {
+		tx.Add("remove the PXE config and DHCP host entry", func() error {
+			if _, err := os.Stat(pxeConfigFile(config, mac)); os.IsNotExist(err) {
+				return errNothingToUndo
+			}
+
+			return removePXEConfig(conn, config, mac, options.Name, addr)
+		})
+
+		err = preparePXE(conn, config, options, mac, addr, fmt.Sprintf("%s %s", serveKernelArgs(config, options, addr, serverURL), kernelArgs))
+		if err != nil {
+			return tx.Fail(err)
+		}
+	}
+
+	pool, err := conn.LookupStoragePoolByName(config.StoragePool)
 	if err != nil {
-		// If we get an error that the domain does not exist
-		if strings.Contains(err.Error(), "Domain not found") {
-			return fmt.Errorf("'%s' does not exist", options.Name)
+		return tx.Fail(err)
+	}
+	defer pool.Free()
+
+	// Only the volumes that are made here are deleted again, an existing volume given with
+	// --extra-disk or kept by rebuild is only attached
+	for i, volume := range volumes {
+		if volume.Path != "" {
+			continue
 		}
 
-		return err
+		file, created, err := createDiskVolume(pool, volume)
+		if err != nil {
+			return tx.Fail(err)
+		}
+
+		if created {
+			tx.Add(fmt.Sprintf("delete the volume %s", file), func() error {
+				return undoVolumes(conn, []string{file})
+			})
+		} else {
+			volumes[i].Format = ""
+		}
+
+		volumes[i].Path = file
+
+		if tx.Interrupted() {
+			return tx.Fail(errors.New("create was interrupted"))
+		}
 	}
 
-	// We need a way to remove the VM disk and we can't do it manually because
-	// of the the file permission. There is probably a more beautiful way to
-	// link a volume with the VM but here we will parse the VMs XML configuration to
-	// find the disk path. Then find the volume object by the disk path and remove it.
-	type DomainXML struct {
-		Devices struct {
-			Disk struct {
-				Source struct {
-					File string `xml:"file,attr"`
-				} `xml:"source"`
-			} `xml:"disk"`
-		} `xml:"devices"`
+	arguments = append(arguments, diskArguments(options, volumes)...)
+
+	// The domain reserves the address in its description until it is removed
+	tx.Add(fmt.Sprintf("remove the VM '%s' and release %s", options.Name, addr), func() error {
+		return undoDomain(conn, options.Name)
+	})
+
+	if tx.Interrupted() {
+		return tx.Fail(errors.New("create was interrupted"))
+	}
+
+	// Run virt-install with our arguments, combine stdout/stderr. The output
+	// is only interesting if something went wrong.
+	output, err := tx.Run(exec.Command(config.VirtInstallPath, arguments...))
+	if err == errInterrupted {
+		return tx.Fail(errors.New("create was interrupted"))
 	}
 
-	xmlDesc, err := domain.GetXMLDesc(0)
 	if err != nil {
-		return err
+		return tx.Fail(fmt.Errorf("virt-install failed: %s\n%s", err, output))
 	}
 
-	var parsedDomain DomainXML
-	if err := xml.Unmarshal([]byte(xmlDesc), &parsedDomain); err != nil {
-		return err
+	domain, err = getDomain(conn, options.Name)
+	if err != nil {
+		return tx.Fail(err)
 	}
 
-	// Force stop the VM if it is running
-	active, err := domain.IsActive()
+	err = setDomainMetadata(domain, metadata)
 	if err != nil {
-		return err
+		return tx.Fail(err)
 	}
 
-	if active {
-		err = domain.DestroyFlags(libvirt.DOMAIN_DESTROY_DEFAULT)
-		if err != nil {
-			return err
+	if tx.Interrupted() {
+		return tx.Fail(errors.New("create was interrupted"))
+	}
+
+	// The VM exists now, a failed installation is left for the user to look at
+	tx.Commit()
+
+	// The temporary directory is removed when we return, so the installer has to get the config first
+	if server != nil && options.NoWait {
+		fmt.Println("Waiting for the installer to fetch the install config")
+
+		select {
+		case <-server.Fetched:
+		case <-time.After(configFetchTimeout):
+			return fmt.Errorf("the installer has not fetched the install config from %s after %s, make sure the firewall allows connections from the lab network", server.URL(), configFetchTimeout)
 		}
 	}
 
-	// Remove the VM
-	err = domain.Undefine()
+	if options.NoWait {
+		fmt.Printf("'%s' is hopefully being installed right now. After the installation is finished the VM will shut down and you have to start it manually.\n", options.Name)
+		return nil
+	}
+
+	// Follow the installation on the serial console and save the output in a log file
+	logFile, err := createInstallLog(options.Name)
 	if err != nil {
 		return err
 	}
+	defer logFile.Close()
+
+	watcher := newInstallWatcher(logFile)
+
+	if options.Console {
+		err = attachConsole(conn, domain, options.Name, watcher, true)
+	} else {
+		fmt.Printf("'%s' is being installed, this takes a while. Follow the installation with 'lab-cli logs --follow %s'.\n", options.Name, options.Name)
+		err = followInstall(conn, domain, watcher)
+	}
 
-	// Find volume by file path
-	volume, err := conn.LookupStorageVolByPath(parsedDomain.Devices.Disk.Source.File)
 	if err != nil {
 		return err
 	}
 
-	// Remove the volume
-	err = volume.Delete(libvirt.STORAGE_VOL_DELETE_NORMAL)
+	if watcher.Failure != "" {
+		return fmt.Errorf("the installation of '%s' failed: %s\nThe VM is left running so you can look at it. The full log is in %s", options.Name, watcher.Failure, logFile.Name())
+	}
+
+	// Detached from the console before the installation was finished
+	active, err := domain.IsActive()
 	if err != nil {
 		return err
 	}
 
-	fmt.Printf("'%s' has been removed\n", options.Name)
+	if active {
+		fmt.Printf("'%s' is still being installed but the output is no longer logged.\n", options.Name)
+		return nil
+	}
+
+	fmt.Printf("'%s' has been installed. The VM has been shut down and you have to start it manually.\n", options.Name)
 
 	return nil
 }
 
-func listCommand() error {
+// Print the install config for a VM without creating anything
+func renderCommand(args []string, config *Config) error {
+	// Parse arguments, render takes the same ones as create
+	options, err := parseCreate(args)
+	if err != nil {
+		return err
+	}
+
 	// Create a libvirt connection
 	conn, err := libvirt.NewConnect("qemu:///system")
 	if err != nil {
 		return err
 	}
 
-	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, '\t', tabwriter.AlignRight)
-	fmt.Fprintln(writer, "Name\tRunning\tIP Address\tAnsible groups")
+	// Use the same address that create would use right now
+	addr, err := nextAvailableAddress(conn, config)
+	if err != nil {
+		return err
+	}
+
+	media, err := getCachedMedia(conn, options.Distro)
+	if err != nil {
+		return err
+	}
 
-	domains, err := getAllDomains(conn)
+	options.LocalMedia = media != nil && media.Type == "iso"
+
+	// The passwords are only for show, create generates new ones
+	secrets, err := newSecrets(config)
 	if err != nil {
 		return err
 	}
 
-	for _, domain := range domains {
-		summary, err := getDomainSummary(&domain)
-		if err != nil {
-			return err
-		}
+	// Render into a buffer first so a broken template does not print half a file
+	var rendered bytes.Buffer
 
-		groups := strings.Join(summary.Groups, ", ")
-		fmt.Fprintf(writer, "%s\t%v\t%s\t%s\n", summary.Name, summary.Status, summary.Address, groups)
+	err = executeTemplate(&rendered, config, options, addr, secrets)
+	if err != nil {
+		return err
 	}
 
-	writer.Flush()
+	fmt.Fprintf(os.Stderr, "# %s for '%s' with the address %s\n", templateOutName(options.Distro), options.Name, addr)
+	fmt.Print(rendered.String())
 
 	return nil
 }
@@ -441,6 +973,11 @@ func actionCommand(args []string, action string) error {
 			return fmt.Errorf("'%s' is already running", options.Name)
 		}
 
+		err = checkNoLinkedClones(conn, domain, options.Name)
+		if err != nil {
+			return err
+		}
+
 		err = domain.Create()
 		if err != nil {
 			return err
@@ -499,17 +1036,13 @@ func sshCommand(args []string, config *Config) error {
 		return err
 	}
 
-	// Prepare arguments for SSH
-	arguments := []string{
-		"-q",
-		"-o", "StrictHostKeyChecking=no",
-		"-i", config.AnsiblePrivateKeyPath,
-		fmt.Sprintf("ansible@%s", summary.Address),
+	if err := summary.Err(); err != nil {
+		return err
 	}
 
 	// Run SSH. This is probably possible to do with golangs crypto/ssh package instead
 	// which would be a better solution
-	cmd := exec.Command("/usr/bin/ssh", arguments...)
+	cmd := exec.Command("/usr/bin/ssh", sshArguments(config, summary.Address)...)
 	cmd.Stdout = os.Stdout
 	cmd.Stdin = os.Stdin
 	cmd.Stderr = os.Stderr
@@ -518,6 +1051,22 @@ func sshCommand(args []string, config *Config) error {
 	return nil
 }
 
+// Arguments for SSH to log in as the Ansible user on address. A remote
+// command can be appended to the returned slice.
+func sshArguments(config *Config, address net.IP) []string {
+	return sshKeyArguments(config.AnsiblePrivateKeyPath, address)
+}
+
+// Same as sshArguments but with another private key
+func sshKeyArguments(keyFile string, address net.IP) []string {
+	return []string{
+		"-q",
+		"-o", "StrictHostKeyChecking=no",
+		"-i", keyFile,
+		fmt.Sprintf("ansible@%s", address),
+	}
+}
+
 func getDomain(conn *libvirt.Connect, name string) (*libvirt.Domain, error) {
 	domain, err := conn.LookupDomainByName(name)
 	if err != nil {
@@ -527,6 +1076,20 @@ func getDomain(conn *libvirt.Connect, name string) (*libvirt.Domain, error) {
 	return domain, nil
 }
 
+// Same as getDomain but with a friendlier error if the domain does not exist
+func getExistingDomain(conn *libvirt.Connect, name string) (*libvirt.Domain, error) {
+	domain, err := getDomain(conn, name)
+	if err != nil {
+		if strings.Contains(err.Error(), "Domain not found") {
+			return nil, fmt.Errorf("'%s' does not exist", name)
+		}
+
+		return nil, err
+	}
+
+	return domain, nil
+}
+
 func getAllDomains(conn *libvirt.Connect) ([]libvirt.Domain, error) {
 	domains, err := conn.ListAllDomains(0)
 	if err != nil {
@@ -561,26 +1124,50 @@ func getDomainDesc(domain *libvirt.Domain) (string, error) {
 		return "", err
 	}
 
-	var parsedDesc DomainXML
-	if err := xml.Unmarshal([]byte(xmlDesc), &parsedDesc); err != nil {
-		return "", err
+	var parsedDesc DomainXML
+	if err := xml.Unmarshal([]byte(xmlDesc), &parsedDesc); err != nil {
+		return "", err
+	}
+
+	return parsedDesc.Description, nil
+}
+
+// Get all disks (not cdrom or floppy devices) attached to the domain
+func getDomainDisks(domain *libvirt.Domain) ([]DomainDisk, error) {
+	type DomainXML struct {
+		Disks []DomainDisk `xml:"devices>disk"`
+	}
+
+	xmlDesc, err := domain.GetXMLDesc(0)
+	if err != nil {
+		return nil, err
+	}
+
+	var parsedDomain DomainXML
+	if err := xml.Unmarshal([]byte(xmlDesc), &parsedDomain); err != nil {
+		return nil, err
+	}
+
+	var disks []DomainDisk
+
+	for _, disk := range parsedDomain.Disks {
+		if disk.Device == "disk" {
+			disks = append(disks, disk)
+		}
 	}
 
-	return parsedDesc.Description, nil
+	return disks, nil
 }
 
+// Get the name, address and groups of a domain. A description that can't be parsed
+// is not an error, so one broken VM doesn't stop lab-cli from working with the others.
+// The problem is saved in the summary instead, see Err.
 func getDomainSummary(domain *libvirt.Domain) (*DomainSummary, error) {
 	desc, err := getDomainDesc(domain)
 	if err != nil {
 		return nil, err
 	}
 
-	descSplit := strings.Split(desc, ":")[1:]
-
-	if len(descSplit) != 2 {
-		return nil, errors.New("something went wrong parsing the domain description")
-	}
-
 	// Get name
 	name, err := domain.GetName()
 	if err != nil {
@@ -593,18 +1180,75 @@ func getDomainSummary(domain *libvirt.Domain) (*DomainSummary, error) {
 		return nil, err
 	}
 
+	domainSum := &DomainSummary{
+		Name:   name,
+		Status: status,
+	}
+
 	// Get IP and groups from our parsed description
-	ip := net.ParseIP(descSplit[0])
+	domainSum.Address, domainSum.Groups, err = parseDescription(desc)
+	if err != nil {
+		domainSum.Problem = err.Error()
+		domainSum.Address = guessAddress(desc)
+	}
+
+	return domainSum, nil
+}
+
+// The error for commands that need a working address for the VM
+func (s *DomainSummary) Err() error {
+	if s.Problem == "" {
+		return nil
+	}
+
+	return fmt.Errorf("'%s' is broken: %s. Fix it with 'lab-cli repair --ip <address> --groups <groups> %s'", s.Name, s.Problem, s.Name)
+}
+
+func joinProblems(problems ...string) string {
+	var found []string
+	for _, problem := range problems {
+		if problem != "" {
+			found = append(found, problem)
+		}
+	}
+
+	return strings.Join(found, ", ")
+}
+
+var addressPattern = regexp.MustCompile(`[0-9]+(\.[0-9]+){3}`)
+
+// Parse a description like labcli:192.168.100.10:web,db
+func parseDescription(desc string) (net.IP, []string, error) {
+	if !strings.HasPrefix(desc, "labcli:") {
+		return nil, nil, errors.New("the description does not start with labcli:")
+	}
+
+	descSplit := strings.Split(desc, ":")[1:]
+
+	if len(descSplit) != 2 {
+		return nil, nil, fmt.Errorf("the description '%s' is not labcli:<address>:<groups>", desc)
+	}
+
+	ip := net.ParseIP(descSplit[0]).To4()
+	if ip == nil {
+		return nil, nil, fmt.Errorf("'%s' in the description is not an IPv4 address", descSplit[0])
+	}
+
 	groups := strings.Split(descSplit[1], ",")
 
-	domainSum := &DomainSummary{
-		Name:    name,
-		Address: ip,
-		Groups:  groups,
-		Status:  status,
+	return ip, groups, nil
+}
+
+// The first thing that looks like an IPv4 address in a broken description. It is
+// better to keep an address that might be in use than to give it to another VM.
+func guessAddress(desc string) net.IP {
+	for _, field := range addressPattern.FindAllString(desc, -1) {
+		if ip := net.ParseIP(field).To4(); ip != nil {
+			return ip
+		}
 	}
 
-	return domainSum, nil
+	return nil
 }
 
 func getNetwork(conn *libvirt.Connect, config *Config) (*libvirt.Network, error) {
@@ -628,6 +1272,14 @@ func createNetwork(conn *libvirt.Connect, config *Config) (*libvirt.Network, err
 		},
 	}
 
+	// dnsmasq answers PXE requests and serves the boot scripts over TFTP. There is no
+	// address range, VMs only get an address from DHCP when they have a host entry.
+	if config.PXE.Enabled {
+		data.IP.TFTP = &NetworkTFTP{Root: config.PXE.TFTPRoot}
+		data.IP.DHCP = &NetworkDHCP{}
+		data.IP.DHCP.Bootp.File = pxeBootFile
+	}
+
 	// Create XML structure
 	xmlData, err := xml.Marshal(data)
 	if err != nil {
@@ -691,24 +1343,120 @@ func (g *GroupFlag) Set(value string) error {
 	return nil
 }
 
+func (a *ArgFlag) String() string {
+	return ""
+}
+
+func (a *ArgFlag) Set(value string) error {
+	*a = append(*a, value)
+
+	return nil
+}
+
+func (v *VarFlag) String() string {
+	return ""
+}
+
+func (v *VarFlag) Set(value string) error {
+	valueSplit := strings.SplitN(value, "=", 2)
+	if len(valueSplit) != 2 || valueSplit[0] == "" {
+		return fmt.Errorf("'%s' is not a valid variable, use key=value", value)
+	}
+
+	(*v)[valueSplit[0]] = valueSplit[1]
+
+	return nil
+}
+
+// Also used by render, which takes the same arguments as create
 func parseCreate(args []string) (*CreateOptions, error) {
 	var groups GroupFlag
-	command := flag.NewFlagSet("create", flag.ExitOnError)
+	var nameservers GroupFlag
+	var packages GroupFlag
+	vars := VarFlag{}
+	templateVars := VarFlag{}
+	command := flag.NewFlagSet(args[1], flag.ExitOnError)
 	ram := command.Int("ram", 2048, "ram help")
 	distro := command.String("distro", "debian", "distribution help")
 	vcpus := command.Int("vcpus", 2, "VCPUs help")
 	disk := command.Int("disk", 10, "disk help")
 	command.Var(&groups, "groups", "groups help")
+	command.Var(&vars, "var", "Ansible host variable as key=value, can be repeated")
+	console := command.Bool("console", false, "attach to the serial console during the installation")
+	noWait := command.Bool("no-wait", false, "return as soon as the installation has started")
+	dryRun := command.Bool("dry-run", false, "show what would be done without creating anything")
+	ip := command.String("ip", "", "address of the VM in the lab network (default the next free one)")
+	var kernelArgs ArgFlag
+	var extraDisks ArgFlag
+	diskFormat := command.String("disk-format", "", "disk format, qcow2 or raw (default from virt-install)")
+	diskBus := command.String("disk-bus", "", "disk bus, virtio, scsi, sata or ide (default from virt-install)")
+	command.Var(&extraDisks, "extra-disk", "extra data disk as size=GB,name=NAME, can be repeated")
+	var virtInstallArgs ArgFlag
+	command.Var(&kernelArgs, "kernel-arg", "extra kernel argument for the installer, can be repeated")
+	command.Var(&virtInstallArgs, "virt-install-arg", "extra argument for virt-install, can be repeated")
+	serve := command.Bool("serve", false, "serve the install config over HTTP on the gateway address (default from config)")
+	locale := command.String("locale", "", "locale, e.g. en_US.UTF-8 (default from config)")
+	keyboard := command.String("keyboard", "", "keyboard layout, e.g. us (default from config)")
+	timezone := command.String("timezone", "", "timezone, e.g. Europe/Berlin (default from config)")
+	mirrorHost := command.String("mirror-host", "", "package mirror host name (default from config)")
+	mirrorPath := command.String("mirror-path", "", "path to the distribution on the mirror (default from config)")
+	proxy := command.String("proxy", "", "HTTP proxy for the installer (default from config)")
+	command.Var(&nameservers, "nameservers", "comma separated list of name servers (default from config or the gateway)")
+	command.Var(&packages, "packages", "comma separated list of extra packages to install")
+	command.Var(&templateVars, "template-var", "variable for the templates as key=value, can be repeated")
 
 	command.Parse(args[2:])
 
 	if len(command.Args()) < 1 {
-		return nil, errors.New("create subcommand requires a name")
+		return nil, fmt.Errorf("%s subcommand requires a name", args[1])
 	}
 
 	// Validate distro selection
-	if *distro != "debian" && *distro != "centos" {
-		return nil, errors.New("selected distribution is not available")
+	if !isDistro(*distro) {
+		return nil, fmt.Errorf("selected distribution is not available, use one of: %s", strings.Join(distros, ", "))
+	}
+
+	if *diskFormat != "" && !isOneOf(*diskFormat, diskFormats) {
+		return nil, fmt.Errorf("'%s' is not a disk format, use one of: %s", *diskFormat, strings.Join(diskFormats, ", "))
+	}
+
+	if *diskBus != "" && !isOneOf(*diskBus, diskBuses) {
+		return nil, fmt.Errorf("'%s' is not a disk bus, use one of: %s", *diskBus, strings.Join(diskBuses, ", "))
+	}
+
+	var disks []ExtraDisk
+	names := make(map[string]bool)
+
+	for i, value := range extraDisks {
+		disk, err := parseExtraDisk(value)
+		if err != nil {
+			return nil, err
+		}
+
+		if disk.Name == "" {
+			disk.Name = fmt.Sprintf("disk%d", i+1)
+		}
+
+		if names[disk.Name] {
+			return nil, fmt.Errorf("there is more than one extra disk with the name '%s'", disk.Name)
+		}
+		names[disk.Name] = true
+
+		disks = append(disks, disk)
+	}
+
+	var address net.IP
+	if *ip != "" {
+		address = net.ParseIP(*ip).To4()
+		if address == nil {
+			return nil, fmt.Errorf("'%s' is not an IPv4 address", *ip)
+		}
+	}
+
+	for _, nameserver := range nameservers {
+		if net.ParseIP(nameserver) == nil {
+			return nil, fmt.Errorf("'%s' is not a valid name server address", nameserver)
+		}
 	}
 
 	// Set default group if not specified
@@ -717,12 +1465,34 @@ func parseCreate(args []string) (*CreateOptions, error) {
 	}
 
 	options := &CreateOptions{
-		Name:   command.Args()[0],
-		Distro: *distro,
-		RAM:    *ram,
-		VCPUs:  *vcpus,
-		Disk:   *disk,
-		Groups: groups,
+		Name:            command.Args()[0],
+		Distro:          *distro,
+		RAM:             *ram,
+		VCPUs:           *vcpus,
+		Disk:            *disk,
+		DiskFormat:      *diskFormat,
+		DiskBus:         *diskBus,
+		ExtraDisks:      disks,
+		Groups:          groups,
+		Vars:            vars,
+		Console:         *console,
+		NoWait:          *noWait,
+		DryRun:          *dryRun,
+		Serve:           *serve,
+		KernelArgs:      kernelArgs,
+		VirtInstallArgs: virtInstallArgs,
+		Install: InstallConfig{
+			Locale:      *locale,
+			Keyboard:    *keyboard,
+			Timezone:    *timezone,
+			HTTPProxy:   *proxy,
+			Nameservers: nameservers,
+			Packages:    packages,
+			Vars:        templateVars,
+		},
+		MirrorHost: *mirrorHost,
+		MirrorPath: *mirrorPath,
+		Address:    address,
 	}
 
 	return options, nil
@@ -752,19 +1522,60 @@ func nextAvailableAddress(conn *libvirt.Connect, config *Config) (net.IP, error)
 		return nil, err
 	}
 
-	// Get next address within the range that is not already used
-	var address net.IP
+	var used []net.IP
 
-	for ip := rangeStart; !ip.Equal(rangeEnd); nextAddress(ip) {
-		available := true
+	for _, domain := range domains {
+		summary, err := getDomainSummary(&domain)
+		if err != nil {
+			return nil, err
+		}
 
-		for _, domain := range domains {
-			summary, err := getDomainSummary(&domain)
+		// A running VM can still tell which address it has, otherwise it could have any address
+		if summary.Address == nil {
+			addresses, err := getDomainAddresses(&domain)
 			if err != nil {
 				return nil, err
 			}
 
-			if ip.Equal(summary.Address) {
+			if len(addresses) == 0 {
+				return nil, fmt.Errorf("no address can be given out while the address of '%s' is unknown, give one with --ip.\n%s", summary.Name, summary.Err())
+			}
+
+			used = append(used, addresses...)
+			continue
+		}
+
+		used = append(used, summary.Address)
+	}
+
+	// Addresses can also be taken by DHCP and DNS host entries, from PXE or by hand
+	network, err := getNetwork(conn, config)
+	if err == nil {
+		defer network.Free()
+
+		xmlDesc, err := network.GetXMLDesc(0)
+		if err != nil {
+			return nil, err
+		}
+
+		var parsedNetwork NetworkXML
+		if err := xml.Unmarshal([]byte(xmlDesc), &parsedNetwork); err != nil {
+			return nil, err
+		}
+
+		used = append(used, networkHostAddresses(&parsedNetwork)...)
+	} else if !strings.Contains(err.Error(), "Network not found") {
+		return nil, err
+	}
+
+	// Get next address within the range that is not already used
+	var address net.IP
+
+	for ip := rangeStart; !ip.Equal(rangeEnd); ip = nextAddress(ip) {
+		available := true
+
+		for _, usedAddress := range used {
+			if ip.Equal(usedAddress) {
 				available = false
 			}
 		}
@@ -782,6 +1593,83 @@ func nextAvailableAddress(conn *libvirt.Connect, config *Config) (net.IP, error)
 	return address, nil
 }
 
+// The IPv4 addresses a running domain has in the ARP table and the DHCP leases of the host
+func getDomainAddresses(domain *libvirt.Domain) ([]net.IP, error) {
+	active, err := domain.IsActive()
+	if err != nil || !active {
+		return nil, err
+	}
+
+	var addresses []net.IP
+
+	sources := []libvirt.DomainInterfaceAddressesSource{
+		libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_ARP,
+		libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_LEASE,
+	}
+
+	for _, source := range sources {
+		interfaces, err := domain.ListAllInterfaceAddresses(source)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, iface := range interfaces {
+			for _, addr := range iface.Addrs {
+				if ip := net.ParseIP(addr.Addr).To4(); ip != nil {
+					addresses = append(addresses, ip)
+				}
+			}
+		}
+	}
+
+	return addresses, nil
+}
+
+// Addresses of the DHCP and DNS host entries of a network
+func networkHostAddresses(network *NetworkXML) []net.IP {
+	var addresses []net.IP
+
+	if network.IP.DHCP != nil {
+		for _, host := range network.IP.DHCP.Hosts {
+			if host.IP != nil {
+				addresses = append(addresses, host.IP)
+			}
+		}
+	}
+
+	if network.DNS != nil {
+		for _, host := range network.DNS.Hosts {
+			if host.IP != nil {
+				addresses = append(addresses, host.IP)
+			}
+		}
+	}
+
+	return addresses
+}
+
+// Check that no VM other than name has the address. Broken VMs count with the
+// address that could be found in their description.
+func checkAddressUnused(conn *libvirt.Connect, name string, address net.IP) error {
+	domains, err := getAllDomains(conn)
+	if err != nil {
+		return err
+	}
+
+	for _, domain := range domains {
+		summary, err := getDomainSummary(&domain)
+		if err != nil {
+			return err
+		}
+
+		if summary.Name != name && address.Equal(summary.Address) {
+			return fmt.Errorf("%s is already used by '%s'", address, summary.Name)
+		}
+	}
+
+	return nil
+}
+
 func getConfigDir() (string, error) {
 	// Check if a custom config directory is set (try to respect XDG spec)
 	// otherwise default to .config in the users home directory
@@ -799,6 +1687,23 @@ func getConfigDir() (string, error) {
 	return path.Join(configHome, "lab-cli"), nil
 }
 
+func getStateDir() (string, error) {
+	// Same as the config directory but for logs and other files that
+	// are not configuration
+	stateHome, exists := os.LookupEnv("XDG_STATE_HOME")
+	if !exists {
+		user, err := user.Current()
+
+		if err != nil {
+			return "", err
+		}
+
+		stateHome = path.Join(user.HomeDir, ".local", "state")
+	}
+
+	return path.Join(stateHome, "lab-cli"), nil
+}
+
 func getTemplateDir() (string, error) {
 	configDir, err := getConfigDir()
 	if err != nil {
@@ -809,83 +1714,265 @@ func getTemplateDir() (string, error) {
 }
 
 func loadConfig(configFile string) (*Config, error) {
-	// Make sure that the config file exists
-	if _, err := os.Stat(configFile); os.IsNotExist(err) {
-		return nil, errors.New("Config file does not exist")
-	} else if err != nil {
+	config := defaultConfig
+
+	// Use the default values if there is no config file
+	if _, err := os.Stat(configFile); err == nil {
+		// Values from the config file will overwrite our default values
+		if _, err := toml.DecodeFile(configFile, &config); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
 		return nil, err
 	}
 
-	// Values from the config file will overwrite our default values
-	config := defaultConfig
-	if _, err := toml.DecodeFile(configFile, &config); err != nil {
-		return nil, err
+	// The paths are used by other programs that don't know about ~
+	configDir := path.Dir(configFile)
+
+	config.VirtInstallPath = expandPath(config.VirtInstallPath)
+	config.VirtClonePath = expandPath(config.VirtClonePath)
+	config.VirtCustomizePath = expandPath(config.VirtCustomizePath)
+	config.AnsiblePrivateKeyPath = configPath(configDir, config.AnsiblePrivateKeyPath)
+	config.AnsiblePublicKeyFile = configPath(configDir, config.AnsiblePublicKeyFile)
+	config.PXE.TFTPRoot = expandPath(config.PXE.TFTPRoot)
+
+	// The key file takes precedence. A missing file is reported by validateConfig
+	// so commands like keygen still work.
+	if config.AnsiblePublicKeyFile != "" {
+		publicKey, err := os.ReadFile(config.AnsiblePublicKeyFile)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		config.AnsiblePublicKey = strings.TrimSpace(string(publicKey))
 	}
 
 	return &config, nil
 }
 
-func renderTemplate(config *Config, options *CreateOptions, outDir string, address net.IP) (string, error) {
-	type Template struct {
-		Hostname   string
-		Domain     string
-		Address    net.IP
-		Netmask    net.IP
-		Gateway    net.IP
-		AnsibleKey string
+// Expand ~ in a path from the config, relative paths are relative to the config directory
+func configPath(configDir string, file string) string {
+	if file == "" {
+		return ""
 	}
 
-	tmpl := Template{
-		Hostname:   options.Name,
-		Domain:     config.Network.Domain,
-		Address:    address,
-		Netmask:    config.Network.Netmask,
-		Gateway:    config.Network.Address,
-		AnsibleKey: config.AnsiblePublicKey,
+	file = expandPath(file)
+	if !path.IsAbs(file) {
+		file = path.Join(configDir, file)
 	}
 
-	// Select distro configuration and set static names on the output file
-	// since Debian seems to require the preseed config to be named "preseed.cfg"
-	var outName string
+	return file
+}
 
-	if options.Distro == "debian" {
-		outName = "preseed.cfg"
-	} else if options.Distro == "centos" {
-		outName = "kickstart.cfg"
+func renderTemplate(config *Config, options *CreateOptions, outDir string, address net.IP, secrets *Secrets) (string, error) {
+	// Create the output file in the temporary directory
+	outFile := path.Join(outDir, templateOutName(options.Distro))
+	f, err := os.Create(outFile)
+	if err != nil {
+		return "", err
 	}
+	defer f.Close()
 
-	templateDir, err := getTemplateDir()
+	err = executeTemplate(f, config, options, address, secrets)
 	if err != nil {
 		return "", err
 	}
 
-	// Parse/render template file and create the output file in the temporary directory
-	templateFile := path.Join(templateDir, fmt.Sprintf("%s.tmpl", outName))
-	t, err := template.ParseFiles(templateFile)
-	if err != nil {
+	return outFile, nil
+}
+
+// Static names on the output file since Debian seems to require the
+// preseed config to be named "preseed.cfg", and NoCloud requires "user-data"
+func templateOutName(distro string) string {
+	if distro == "centos" {
+		return "kickstart.cfg"
+	} else if distro == "ubuntu" {
+		return "user-data"
+	}
+
+	return "preseed.cfg"
+}
+
+// Write the meta-data file for a NoCloud seed next to user-data
+func writeMetaData(options *CreateOptions, outDir string) (string, error) {
+	metaFile := path.Join(outDir, "meta-data")
+
+	data := fmt.Sprintf("instance-id: %s\nlocal-hostname: %s\n", options.Name, options.Name)
+	if err := os.WriteFile(metaFile, []byte(data), 0644); err != nil {
 		return "", err
 	}
 
-	outFile := path.Join(outDir, outName)
-	f, err := os.Create(outFile)
+	return metaFile, nil
+}
+
+func isDistro(distro string) bool {
+	return isOneOf(distro, distros)
+}
+
+// Settings from the config for a distro
+func getDistroConfig(config *Config, distro string) DistroConfig {
+	switch distro {
+	case "centos":
+		return config.Centos
+	case "ubuntu":
+		return config.Ubuntu
+	}
+
+	return config.Debian
+}
+
+// Render the template for the selected distro into w
+func executeTemplate(w io.Writer, config *Config, options *CreateOptions, address net.IP, secrets *Secrets) error {
+	type Template struct {
+		Hostname            string
+		Domain              string
+		Address             net.IP
+		Netmask             net.IP
+		Gateway             net.IP
+		AnsibleKey          string
+		RootPasswordHash    string
+		AnsiblePasswordHash string
+		Prefix              int
+		LocalMedia          bool
+		Locale              string
+		Keyboard            string
+		Timezone            string
+		MirrorHost          string
+		MirrorPath          string
+		HTTPProxy           string
+		Nameservers         []string
+		Packages            []string
+		Vars                map[string]string
+	}
+
+	install, distro := installSettings(config, options)
+
+	// Netplan wants the netmask as a prefix length
+	prefix, _ := net.IPMask(config.Network.Netmask.To4()).Size()
+
+	tmpl := Template{
+		Hostname:    options.Name,
+		Domain:      config.Network.Domain,
+		Address:     address,
+		Netmask:     config.Network.Netmask,
+		Prefix:      prefix,
+		LocalMedia:  options.LocalMedia,
+		Gateway:     config.Network.Address,
+		AnsibleKey:  config.AnsiblePublicKey,
+		Locale:      install.Locale,
+		Keyboard:    install.Keyboard,
+		Timezone:    install.Timezone,
+		MirrorHost:  distro.MirrorHost,
+		MirrorPath:  distro.MirrorPath,
+		HTTPProxy:   install.HTTPProxy,
+		Nameservers: install.Nameservers,
+		Packages:    install.Packages,
+		Vars:        install.Vars,
+	}
+
+	// Only the hashes end up in the install config
+	var err error
+
+	tmpl.RootPasswordHash, err = hashPassword(secrets.RootPassword)
 	if err != nil {
-		return "", err
+		return err
+	}
+
+	// Without a password the ansible user is locked and can only log in with the SSH key
+	if secrets.AnsiblePassword != "" {
+		tmpl.AnsiblePasswordHash, err = hashPassword(secrets.AnsiblePassword)
+		if err != nil {
+			return err
+		}
 	}
 
-	err = t.Execute(f, tmpl)
+	// Parse/render template file
+	t, err := parseTemplate(fmt.Sprintf("%s.tmpl", templateOutName(options.Distro)))
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return err
+	}
+
+	return t.Execute(w, tmpl)
+}
+
+// Merge the install settings from the config with the ones given to create
+func installSettings(config *Config, options *CreateOptions) (InstallConfig, DistroConfig) {
+	install := config.Install
+
+	distro := getDistroConfig(config, options.Distro)
+
+	if options.Install.Locale != "" {
+		install.Locale = options.Install.Locale
 	}
 
-	f.Close()
+	if options.Install.Keyboard != "" {
+		install.Keyboard = options.Install.Keyboard
+	}
 
-	return outFile, nil
+	if options.Install.Timezone != "" {
+		install.Timezone = options.Install.Timezone
+	}
+
+	if options.Install.HTTPProxy != "" {
+		install.HTTPProxy = options.Install.HTTPProxy
+	}
+
+	if len(options.Install.Nameservers) > 0 {
+		install.Nameservers = options.Install.Nameservers
+	}
+
+	// Use the gateway (libvirts dnsmasq) if nothing else is set
+	if len(install.Nameservers) < 1 {
+		install.Nameservers = []string{config.Network.Address.String()}
+	}
+
+	// Packages are added to the ones from the config
+	install.Packages = append(append([]string{}, config.Install.Packages...), options.Install.Packages...)
+
+	// Variables from create overwrite the ones from the config
+	install.Vars = make(map[string]string)
+	for key, value := range config.Install.Vars {
+		install.Vars[key] = value
+	}
+	for key, value := range options.Install.Vars {
+		install.Vars[key] = value
+	}
+
+	if options.MirrorHost != "" {
+		distro.MirrorHost = options.MirrorHost
+	}
+
+	if options.MirrorPath != "" {
+		distro.MirrorPath = options.MirrorPath
+	}
+
+	return install, distro
+}
+
+// Join arguments to a command line that can be pasted into a shell
+func shellJoin(args []string) string {
+	var quoted []string
+
+	for _, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t\n'\"\\$`;&|<>()*?[]#~!{}") {
+			arg = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+		}
+
+		quoted = append(quoted, arg)
+	}
+
+	return strings.Join(quoted, " ")
 }
 
 // Get next IPv4 address - from a stackoverflow reply
+// The address after origAddress, which is left as it is
 func nextAddress(origAddress net.IP) net.IP {
-	ip := origAddress.To4()
+	if origAddress.To4() == nil {
+		return nil
+	}
+
+	ip := make(net.IP, net.IPv4len)
+	copy(ip, origAddress.To4())
 
 	for i := len(ip) - 1; i >= 0; i-- {
 		ip[i]++
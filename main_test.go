@@ -1,11 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"net"
 	"os"
 	"os/user"
 	"path"
+	"strings"
 	"testing"
+
+	"gopkg.in/yaml.v2"
 )
 
 // This test also tests getConfigDir
@@ -32,6 +36,29 @@ func TestGetTemplateDir(t *testing.T) {
 	}
 }
 
+func TestGetStateDir(t *testing.T) {
+	// Test without XDG_STATE_HOME set
+	os.Unsetenv("XDG_STATE_HOME")
+
+	user, _ := user.Current()
+	expectedDir := path.Join(user.HomeDir, ".local", "state", "lab-cli")
+	stateDir, _ := getStateDir()
+
+	if stateDir != expectedDir {
+		t.Errorf("did not get the state directory we wanted. got: %s, want: %s", stateDir, expectedDir)
+	}
+
+	// With XDG_STATE_HOME set
+	os.Setenv("XDG_STATE_HOME", path.Join("/tmp", "state"))
+
+	expectedDir = path.Join("/tmp", "state", "lab-cli")
+	stateDir, _ = getStateDir()
+
+	if stateDir != expectedDir {
+		t.Errorf("did not get the state directory we wanted. got: %s, want: %s", stateDir, expectedDir)
+	}
+}
+
 func TestNextAddress(t *testing.T) {
 	var tests = []struct {
 		ip   net.IP
@@ -50,4 +77,194 @@ func TestNextAddress(t *testing.T) {
 			t.Errorf("invalid next IP address. got: %s, want: %s", nextAddr, test.want)
 		}
 	}
+
+	// The range in the config must not change when it is walked
+	ip := net.ParseIP("192.168.100.50")
+	nextAddress(ip)
+	if !ip.Equal(net.ParseIP("192.168.100.50")) {
+		t.Errorf("nextAddress changed its argument to %s", ip)
+	}
+}
+
+func TestInstallSettings(t *testing.T) {
+	config := defaultConfig
+	config.Install.Packages = []string{"vim"}
+	config.Install.Vars = map[string]string{"a": "config", "b": "config"}
+
+	options := &CreateOptions{
+		Name:   "lab01",
+		Distro: "centos",
+		Install: InstallConfig{
+			Timezone: "Europe/Berlin",
+			Packages: []string{"curl"},
+			Vars:     map[string]string{"b": "create"},
+		},
+		MirrorHost: "mirror.example.com",
+	}
+
+	install, distro := installSettings(&config, options)
+
+	if install.Locale != "en_US.UTF-8" || install.Timezone != "Europe/Berlin" {
+		t.Errorf("did not get the locale and timezone we wanted. got: %s, %s", install.Locale, install.Timezone)
+	}
+
+	if len(install.Nameservers) != 1 || install.Nameservers[0] != "192.168.100.1" {
+		t.Errorf("the gateway should be the default name server. got: %v", install.Nameservers)
+	}
+
+	if len(install.Packages) != 2 || install.Packages[0] != "vim" || install.Packages[1] != "curl" {
+		t.Errorf("did not get the packages we wanted. got: %v", install.Packages)
+	}
+
+	if install.Vars["a"] != "config" || install.Vars["b"] != "create" {
+		t.Errorf("did not get the variables we wanted. got: %v", install.Vars)
+	}
+
+	if distro.MirrorHost != "mirror.example.com" || distro.MirrorPath != config.Centos.MirrorPath {
+		t.Errorf("did not get the mirror we wanted. got: %s%s", distro.MirrorHost, distro.MirrorPath)
+	}
+
+	// The config should not be changed
+	if len(config.Install.Packages) != 1 || config.Install.Vars["b"] != "config" {
+		t.Errorf("the config was modified")
+	}
+}
+
+func TestShellJoin(t *testing.T) {
+	args := []string{"/usr/bin/virt-install", "--name", "lab01", "--extra-args", "auto console=ttyS0", "--metadata", "description=it's"}
+	want := `/usr/bin/virt-install --name lab01 --extra-args 'auto console=ttyS0' --metadata 'description=it'\''s'`
+
+	if got := shellJoin(args); got != want {
+		t.Errorf("did not get the command line we wanted. got: %s, want: %s", got, want)
+	}
+}
+
+func TestExecuteTemplateUbuntu(t *testing.T) {
+	os.Setenv("XDG_CONFIG_HOME", t.TempDir())
+
+	config := defaultConfig
+	config.Install.Packages = []string{"vim"}
+	config.Install.HTTPProxy = "http://proxy.lab.local:3128"
+
+	options := &CreateOptions{Name: "lab01", Distro: "ubuntu"}
+	secrets := &Secrets{RootPassword: "root"}
+
+	var buf bytes.Buffer
+	if err := executeTemplate(&buf, &config, options, net.ParseIP("192.168.100.10"), secrets); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// The rendered user-data has to be valid YAML for the installer
+	var userData struct {
+		Autoinstall struct {
+			Proxy   string `yaml:"proxy"`
+			Network struct {
+				Ethernets map[string]struct {
+					Addresses []string `yaml:"addresses"`
+				} `yaml:"ethernets"`
+			} `yaml:"network"`
+			Packages     []string `yaml:"packages"`
+			LateCommands []string `yaml:"late-commands"`
+		} `yaml:"autoinstall"`
+	}
+
+	if err := yaml.Unmarshal(buf.Bytes(), &userData); err != nil {
+		t.Fatalf("the user-data is not valid YAML: %s\n%s", err, buf.String())
+	}
+
+	addresses := userData.Autoinstall.Network.Ethernets["primary"].Addresses
+	if len(addresses) != 1 || addresses[0] != "192.168.100.10/24" {
+		t.Errorf("did not get the address we wanted. got: %v", addresses)
+	}
+
+	if userData.Autoinstall.Proxy != config.Install.HTTPProxy {
+		t.Errorf("did not get the proxy we wanted. got: %s", userData.Autoinstall.Proxy)
+	}
+
+	if packages := userData.Autoinstall.Packages; len(packages) != 3 || packages[2] != "vim" {
+		t.Errorf("did not get the packages we wanted. got: %v", packages)
+	}
+
+	if len(userData.Autoinstall.LateCommands) != 1 || !strings.Contains(userData.Autoinstall.LateCommands[0], "usermod -p '$6$") {
+		t.Errorf("the root password hash is missing from late-commands. got: %v", userData.Autoinstall.LateCommands)
+	}
+}
+
+func TestParseCreateArgs(t *testing.T) {
+	args := []string{"lab-cli", "create", "--kernel-arg", "console=ttyS0,115200n8", "--kernel-arg", "debug", "--virt-install-arg=--cpu=host-passthrough", "lab01"}
+
+	options, err := parseCreate(args)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// Commas are part of the argument, not a separator
+	if len(options.KernelArgs) != 2 || options.KernelArgs[0] != "console=ttyS0,115200n8" || options.KernelArgs[1] != "debug" {
+		t.Errorf("did not get the kernel arguments we wanted. got: %v", options.KernelArgs)
+	}
+
+	if len(options.VirtInstallArgs) != 1 || options.VirtInstallArgs[0] != "--cpu=host-passthrough" {
+		t.Errorf("did not get the virt-install arguments we wanted. got: %v", options.VirtInstallArgs)
+	}
+}
+
+func TestParseCreateIP(t *testing.T) {
+	options, err := parseCreate([]string{"lab-cli", "create", "--ip", "192.168.100.40", "lab01"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if !options.Address.Equal(net.ParseIP("192.168.100.40")) {
+		t.Errorf("did not get the address we wanted. got: %v", options.Address)
+	}
+
+	if _, err := parseCreate([]string{"lab-cli", "create", "--ip", "fe80::1", "lab01"}); err == nil {
+		t.Error("an IPv6 address was accepted")
+	}
+}
+
+func TestParseDescription(t *testing.T) {
+	var tests = []struct {
+		desc    string
+		address net.IP
+		groups  []string
+		valid   bool
+	}{
+		{"labcli:192.168.100.10:web,db", net.ParseIP("192.168.100.10"), []string{"web", "db"}, true},
+		{formatDescription(net.ParseIP("192.168.100.11"), []string{"web"}), net.ParseIP("192.168.100.11"), []string{"web"}, true},
+		{"labcli:192.168.100.10", nil, nil, false},
+		{"labcli:192.168.100.x:web", nil, nil, false},
+		{"labcli:192.168.100.10:web:db", nil, nil, false},
+		{"something else", nil, nil, false},
+	}
+
+	for _, test := range tests {
+		address, groups, err := parseDescription(test.desc)
+		if (err == nil) != test.valid {
+			t.Errorf("unexpected result for '%s': %v", test.desc, err)
+			continue
+		}
+
+		if !address.Equal(test.address) || strings.Join(groups, ",") != strings.Join(test.groups, ",") {
+			t.Errorf("got %s and %v for '%s'", address, groups, test.desc)
+		}
+	}
+}
+
+func TestGuessAddress(t *testing.T) {
+	var tests = []struct {
+		desc string
+		want net.IP
+	}{
+		{"labcli:192.168.100.10:web:db", net.ParseIP("192.168.100.10")},
+		{"labcli:web:192.168.100.12", net.ParseIP("192.168.100.12")},
+		{"labcli:999.1.1.1 192.168.100.13", net.ParseIP("192.168.100.13")},
+		{"labcli:web", nil},
+	}
+
+	for _, test := range tests {
+		if got := guessAddress(test.desc); !got.Equal(test.want) {
+			t.Errorf("got %s for '%s', want %s", got, test.desc, test.want)
+		}
+	}
 }
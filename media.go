@@ -0,0 +1,563 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	libvirt "libvirt.org/libvirt-go"
+)
+
+// Installer media in the storage pool. Either an ISO image or a kernel and initrd pair.
+type Media struct {
+	Type    string    `toml:"type"`
+	Sources []string  `toml:"sources"`
+	SHA256  []string  `toml:"sha256"`
+	Volumes []string  `toml:"volumes"`
+	AddedAt time.Time `toml:"added_at"`
+}
+
+type MediaAddOptions struct {
+	Distro  string
+	Sources []string
+	SHA256  []string
+}
+
+type VolumeXML struct {
+	XMLName  xml.Name `xml:"volume"`
+	Name     string   `xml:"name"`
+	Capacity struct {
+		Unit  string `xml:"unit,attr"`
+		Value int64  `xml:",chardata"`
+	} `xml:"capacity"`
+	// In bytes, nil leaves it to libvirt which allocates all of it
+	Allocation *int64 `xml:"allocation,omitempty"`
+	Target     struct {
+		Format struct {
+			Type string `xml:"type,attr"`
+		} `xml:"format"`
+	} `xml:"target"`
+	// The image the volume is an overlay on
+	BackingStore *VolumeBackingStore `xml:"backingStore"`
+}
+
+type VolumeBackingStore struct {
+	Path   string `xml:"path"`
+	Format struct {
+		Type string `xml:"type,attr"`
+	} `xml:"format"`
+}
+
+func mediaCommand(args []string, config *Config) error {
+	if len(args) < 3 {
+		return errors.New("media subcommand requires an action (add, list, rm)")
+	}
+
+	switch args[2] {
+	case "add":
+		return mediaAddCommand(args, config)
+	case "list":
+		return mediaListCommand()
+	case "rm":
+		if len(args) < 4 {
+			return errors.New("media rm requires a distribution")
+		}
+
+		return mediaRemoveCommand(args[3])
+	}
+
+	return fmt.Errorf("'%s' is not a valid media action", args[2])
+}
+
+// Verify and import installer media into the storage pool, replacing the media
+// that the distro already has
+func mediaAddCommand(args []string, config *Config) error {
+	options, err := parseMediaAdd(args)
+	if err != nil {
+		return err
+	}
+
+	// Create a libvirt connection
+	conn, err := libvirt.NewConnect("qemu:///system")
+	if err != nil {
+		return err
+	}
+
+	pool, err := conn.LookupStoragePoolByName(config.StoragePool)
+	if err != nil {
+		return err
+	}
+	defer pool.Free()
+
+	media := Media{
+		Type:    "iso",
+		Sources: options.Sources,
+		AddedAt: time.Now(),
+	}
+
+	if len(options.Sources) == 2 {
+		media.Type = "kernel"
+	}
+
+	names := mediaVolumeNames(options.Distro, media.Type, media.AddedAt)
+
+	// Download and verify everything before the old media is touched
+	var files []string
+
+	for i, source := range options.Sources {
+		file, temporary, err := fetchMedia(source)
+		if err != nil {
+			return err
+		}
+
+		if temporary {
+			defer os.Remove(file)
+		}
+
+		checksum, err := sha256File(file)
+		if err != nil {
+			return err
+		}
+
+		if len(options.SHA256) > 0 && !strings.EqualFold(options.SHA256[i], checksum) {
+			return fmt.Errorf("the checksum of %s does not match. got: %s, want: %s", source, checksum, options.SHA256[i])
+		}
+
+		files = append(files, file)
+		media.SHA256 = append(media.SHA256, checksum)
+	}
+
+	// The new volumes get names of their own, so the old media stays usable until the index points to them
+	for i, file := range files {
+		fmt.Printf("Importing %s into the storage pool '%s'\n", options.Sources[i], config.StoragePool)
+
+		volume, err := uploadVolume(conn, pool, names[i], file)
+		if err != nil {
+			deleteMediaVolumes(conn, media.Volumes)
+			return err
+		}
+
+		media.Volumes = append(media.Volumes, volume)
+	}
+
+	index, err := loadMediaIndex()
+	if err != nil {
+		deleteMediaVolumes(conn, media.Volumes)
+		return err
+	}
+
+	old := index[options.Distro].Volumes
+	index[options.Distro] = media
+
+	if err := saveMediaIndex(index); err != nil {
+		deleteMediaVolumes(conn, media.Volumes)
+		return err
+	}
+
+	if err := deleteMediaVolumes(conn, old); err != nil {
+		fmt.Printf("The old media for '%s' could not be removed, 'lab-cli gc' can do it later: %s\n", options.Distro, err)
+	}
+
+	fmt.Printf("'%s' is now installed from the imported media\n", options.Distro)
+
+	return nil
+}
+
+func mediaListCommand() error {
+	index, err := loadMediaIndex()
+	if err != nil {
+		return err
+	}
+
+	// Create a libvirt connection
+	conn, err := libvirt.NewConnect("qemu:///system")
+	if err != nil {
+		return err
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, '\t', tabwriter.AlignRight)
+	fmt.Fprintln(writer, "DISTRO\tTYPE\tSTATUS\tSOURCE\tSHA256\tADDED")
+
+	for _, distro := range distros {
+		media, exists := index[distro]
+		if !exists {
+			continue
+		}
+
+		status := "ok"
+		if !mediaVolumesExist(conn, &media) {
+			status = "missing"
+		}
+
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\n", distro, media.Type, status, strings.Join(media.Sources, ","),
+			shortChecksum(media.SHA256), media.AddedAt.Format("2006-01-02 15:04"))
+	}
+
+	writer.Flush()
+
+	return nil
+}
+
+func mediaRemoveCommand(distro string) error {
+	index, err := loadMediaIndex()
+	if err != nil {
+		return err
+	}
+
+	if _, exists := index[distro]; !exists {
+		return fmt.Errorf("there is no media for '%s'", distro)
+	}
+
+	// Create a libvirt connection
+	conn, err := libvirt.NewConnect("qemu:///system")
+	if err != nil {
+		return err
+	}
+
+	if err := deleteMediaVolumes(conn, index[distro].Volumes); err != nil {
+		return err
+	}
+
+	delete(index, distro)
+
+	if err := saveMediaIndex(index); err != nil {
+		return err
+	}
+
+	fmt.Printf("The media for '%s' has been removed\n", distro)
+
+	return nil
+}
+
+// Cached media for a distro, or nil if there is none or its volumes are gone
+func getCachedMedia(conn *libvirt.Connect, distro string) (*Media, error) {
+	index, err := loadMediaIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	media, exists := index[distro]
+	if !exists || !mediaVolumesExist(conn, &media) {
+		return nil, nil
+	}
+
+	return &media, nil
+}
+
+func mediaVolumesExist(conn *libvirt.Connect, media *Media) bool {
+	for _, file := range media.Volumes {
+		volume, err := conn.LookupStorageVolByPath(file)
+		if err != nil {
+			return false
+		}
+		volume.Free()
+	}
+
+	return true
+}
+
+// Names for the volumes of media, with the time it was added so they don't collide with
+// the volumes of the media it replaces
+func mediaVolumeNames(distro string, kind string, added time.Time) []string {
+	stamp := added.UTC().Format("20060102150405")
+
+	if kind == "kernel" {
+		return []string{
+			fmt.Sprintf("labcli-media-%s-%s-vmlinuz", distro, stamp),
+			fmt.Sprintf("labcli-media-%s-%s-initrd", distro, stamp),
+		}
+	}
+
+	return []string{fmt.Sprintf("labcli-media-%s-%s.iso", distro, stamp)}
+}
+
+// The start of the first checksum, an index edited by hand may not have a whole one
+func shortChecksum(checksums []string) string {
+	if len(checksums) == 0 {
+		return "-"
+	}
+
+	if len(checksums[0]) < 12 {
+		return checksums[0]
+	}
+
+	return checksums[0][:12]
+}
+
+// Remove volumes of media, the ones that are already gone are skipped
+func deleteMediaVolumes(conn *libvirt.Connect, files []string) error {
+	for _, file := range files {
+		volume, err := conn.LookupStorageVolByPath(file)
+		if err != nil {
+			// Already removed by someone else
+			if strings.Contains(err.Error(), "Storage volume not found") {
+				continue
+			}
+
+			return err
+		}
+
+		err = volume.Delete(libvirt.STORAGE_VOL_DELETE_NORMAL)
+		volume.Free()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Arguments for virt-install that tell it where the installer is
+func installSourceArgs(config *Config, distro string, media *Media) []string {
+	if media != nil && media.Type == "kernel" {
+		return []string{"--install", fmt.Sprintf("kernel=%s,initrd=%s", media.Volumes[0], media.Volumes[1])}
+	}
+
+	location := getDistroConfig(config, distro).Location
+	if media != nil {
+		location = media.Volumes[0]
+	}
+
+	// virt-install does not know where they are on the live-server ISO
+	if distro == "ubuntu" {
+		location += ",kernel=casper/vmlinuz,initrd=casper/initrd"
+	}
+
+	return []string{"--location", location}
+}
+
+// Get a local file for source, URLs are downloaded into a temporary file
+func fetchMedia(source string) (string, bool, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		file := expandPath(source)
+		if _, err := os.Stat(file); err != nil {
+			return "", false, err
+		}
+
+		return file, false, nil
+	}
+
+	fmt.Printf("Downloading %s\n", source)
+
+	resp, err := http.Get(source)
+	if err != nil {
+		return "", false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", false, fmt.Errorf("could not download %s: %s", source, resp.Status)
+	}
+
+	f, err := ioutil.TempFile("", "lab-cli-media")
+	if err != nil {
+		return "", false, err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		os.Remove(f.Name())
+		return "", false, err
+	}
+
+	return f.Name(), true, nil
+}
+
+func sha256File(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Create a volume in the pool with the content of file, returns the path of the volume.
+// The volume is uploaded through libvirt since we can't write to the pool directory.
+func uploadVolume(conn *libvirt.Connect, pool *libvirt.StoragePool, name string, file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	data := VolumeXML{Name: name}
+	data.Capacity.Unit = "bytes"
+	data.Capacity.Value = info.Size()
+	data.Target.Format.Type = "raw"
+
+	xmlData, err := xml.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+
+	volume, err := pool.StorageVolCreateXML(string(xmlData), 0)
+	if err != nil {
+		return "", err
+	}
+	defer volume.Free()
+
+	if err := sendFile(conn, volume, f, info.Size()); err != nil {
+		volume.Delete(libvirt.STORAGE_VOL_DELETE_NORMAL)
+		return "", err
+	}
+
+	return volume.GetPath()
+}
+
+func sendFile(conn *libvirt.Connect, volume *libvirt.StorageVol, r io.Reader, size int64) error {
+	stream, err := conn.NewStream(0)
+	if err != nil {
+		return err
+	}
+	defer stream.Free()
+
+	if err := volume.Upload(stream, 0, uint64(size), 0); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 1024*1024)
+
+	for {
+		n, err := r.Read(buf)
+
+		for sent := 0; sent < n; {
+			s, err := stream.Send(buf[sent:n])
+			if err != nil {
+				stream.Abort()
+				return err
+			}
+
+			sent += s
+		}
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			stream.Abort()
+			return err
+		}
+	}
+
+	return stream.Finish()
+}
+
+func getMediaIndexFile() (string, error) {
+	stateDir, err := getStateDir()
+	if err != nil {
+		return "", err
+	}
+
+	return path.Join(stateDir, "media.toml"), nil
+}
+
+// Load the imported media, the key is the distro
+func loadMediaIndex() (map[string]Media, error) {
+	index := make(map[string]Media)
+
+	indexFile, err := getMediaIndexFile()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := os.Stat(indexFile); os.IsNotExist(err) {
+		return index, nil
+	}
+
+	if _, err := toml.DecodeFile(indexFile, &index); err != nil {
+		return nil, err
+	}
+
+	return index, nil
+}
+
+func saveMediaIndex(index map[string]Media) error {
+	indexFile, err := getMediaIndexFile()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(path.Dir(indexFile), 0755); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so the old index is intact if something goes wrong
+	f, err := ioutil.TempFile(path.Dir(indexFile), ".media")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := toml.NewEncoder(f).Encode(index); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), indexFile)
+}
+
+func parseMediaAdd(args []string) (*MediaAddOptions, error) {
+	var checksums GroupFlag
+	command := flag.NewFlagSet("media add", flag.ExitOnError)
+	command.Var(&checksums, "sha256", "expected SHA-256 checksum, comma separated for a kernel and initrd")
+
+	command.Parse(args[3:])
+
+	if len(command.Args()) < 2 || len(command.Args()) > 3 {
+		return nil, errors.New("media add requires a distribution and an ISO, or a kernel and an initrd (files or URLs)")
+	}
+
+	options := &MediaAddOptions{
+		Distro:  command.Args()[0],
+		Sources: command.Args()[1:],
+		SHA256:  checksums,
+	}
+
+	if !isDistro(options.Distro) {
+		return nil, fmt.Errorf("'%s' is not a distribution, use one of: %s", options.Distro, strings.Join(distros, ", "))
+	}
+
+	// The live-server installer needs the whole ISO
+	if options.Distro == "ubuntu" && len(options.Sources) == 2 {
+		return nil, errors.New("ubuntu can only be installed from an ISO")
+	}
+
+	if len(options.SHA256) > 0 && len(options.SHA256) != len(options.Sources) {
+		return nil, fmt.Errorf("got %d checksums for %d files", len(options.SHA256), len(options.Sources))
+	}
+
+	return options, nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseMediaAdd(t *testing.T) {
+	var tests = []struct {
+		args  []string
+		valid bool
+	}{
+		{[]string{"lab-cli", "media", "add", "debian", "debian.iso"}, true},
+		{[]string{"lab-cli", "media", "add", "--sha256", "a,b", "centos", "vmlinuz", "initrd.img"}, true},
+		{[]string{"lab-cli", "media", "add", "debian"}, false},
+		{[]string{"lab-cli", "media", "add", "arch", "arch.iso"}, false},
+		{[]string{"lab-cli", "media", "add", "ubuntu", "vmlinuz", "initrd"}, false},
+		{[]string{"lab-cli", "media", "add", "--sha256", "a", "centos", "vmlinuz", "initrd.img"}, false},
+	}
+
+	for _, test := range tests {
+		_, err := parseMediaAdd(test.args)
+		if (err == nil) != test.valid {
+			t.Errorf("unexpected result for %v: %v", test.args, err)
+		}
+	}
+}
+
+func TestSha256File(t *testing.T) {
+	file := path.Join(t.TempDir(), "media")
+	if err := os.WriteFile(file, []byte("abc"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	checksum, err := sha256File(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"; checksum != want {
+		t.Errorf("did not get the checksum we wanted. got: %s, want: %s", checksum, want)
+	}
+}
+
+func TestInstallSourceArgs(t *testing.T) {
+	config := defaultConfig
+
+	var tests = []struct {
+		distro string
+		media  *Media
+		want   []string
+	}{
+		{"debian", nil, []string{"--location", config.Debian.Location}},
+		{"debian", &Media{Type: "iso", Volumes: []string{"/pool/debian.iso"}}, []string{"--location", "/pool/debian.iso"}},
+		{"centos", &Media{Type: "kernel", Volumes: []string{"/pool/vmlinuz", "/pool/initrd"}}, []string{"--install", "kernel=/pool/vmlinuz,initrd=/pool/initrd"}},
+		{"ubuntu", &Media{Type: "iso", Volumes: []string{"/pool/ubuntu.iso"}}, []string{"--location", "/pool/ubuntu.iso,kernel=casper/vmlinuz,initrd=casper/initrd"}},
+	}
+
+	for _, test := range tests {
+		if got := installSourceArgs(&config, test.distro, test.media); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("did not get the arguments we wanted. got: %v, want: %v", got, test.want)
+		}
+	}
+}
+
+func TestMediaIndex(t *testing.T) {
+	os.Setenv("XDG_STATE_HOME", t.TempDir())
+	defer os.Unsetenv("XDG_STATE_HOME")
+
+	media := Media{
+		Type:    "iso",
+		Sources: []string{"https://example.com/debian.iso"},
+		SHA256:  []string{"ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		Volumes: []string{"/var/lib/libvirt/images/labcli-media-debian.iso"},
+		AddedAt: time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+
+	if err := saveMediaIndex(map[string]Media{"debian": media}); err != nil {
+		t.Fatal(err)
+	}
+
+	index, err := loadMediaIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(index["debian"], media) {
+		t.Errorf("did not get the media we saved. got: %+v, want: %+v", index["debian"], media)
+	}
+
+	indexFile, err := getMediaIndexFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := os.ReadDir(path.Dir(indexFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 1 {
+		t.Errorf("the temporary file was left behind: %v", files)
+	}
+}
+
+func TestMediaVolumeNames(t *testing.T) {
+	added := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	want := []string{"labcli-media-debian-20210102030405.iso"}
+	if got := mediaVolumeNames("debian", "iso", added); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	want = []string{"labcli-media-centos-20210102030405-vmlinuz", "labcli-media-centos-20210102030405-initrd"}
+	if got := mediaVolumeNames("centos", "kernel", added); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestShortChecksum(t *testing.T) {
+	var tests = []struct {
+		checksums []string
+		want      string
+	}{
+		{[]string{"ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"}, "ba7816bf8f01"},
+		{[]string{"ba7816"}, "ba7816"},
+		{nil, "-"},
+	}
+
+	for _, test := range tests {
+		if got := shortChecksum(test.checksums); got != test.want {
+			t.Errorf("got %s for %v, want %s", got, test.checksums, test.want)
+		}
+	}
+}
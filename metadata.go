@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	libvirt "libvirt.org/libvirt-go"
+)
+
+// Namespace for our own metadata element in the domain XML
+const (
+	metadataKey = "labcli"
+	metadataURI = "https://github.com/jagardaniel/lab-cli"
+)
+
+// Extra information about a VM that does not fit in the description. The IP address
+// and groups still live in the description since that is what marks a VM as ours.
+type DomainMetadata struct {
+	XMLName   xml.Name    `xml:"labcli"`
+	Distro    string      `xml:"distro,omitempty"`
+	CreatedAt *time.Time  `xml:"created_at,omitempty"`
+	Vars      []DomainVar `xml:"vars>var"`
+	// Given to create, so the VM can be created again the same way
+	KernelArgs      []string    `xml:"kernel_args>arg"`
+	VirtInstallArgs []string    `xml:"virt_install_args>arg"`
+	DiskFormat      string      `xml:"disk_format,omitempty"`
+	DiskBus         string      `xml:"disk_bus,omitempty"`
+	ExtraDisks      []ExtraDisk `xml:"extra_disks>disk"`
+	Disk            int         `xml:"disk,omitempty"`
+	// Install settings given to create, the rest comes from the config
+	Install *DomainInstall `xml:"install,omitempty"`
+	// Kernel arguments the config of the distro had, so a rebuild uses them as well
+	ConfigKernelArgs []string `xml:"config_kernel_args>arg"`
+	// The description a VM had before it was adopted, it gets it back when it is forgotten
+	OriginalDescription string `xml:"original_description,omitempty"`
+}
+
+// Install settings that were changed with flags to create
+type DomainInstall struct {
+	Locale      string      `xml:"locale,omitempty"`
+	Keyboard    string      `xml:"keyboard,omitempty"`
+	Timezone    string      `xml:"timezone,omitempty"`
+	HTTPProxy   string      `xml:"http_proxy,omitempty"`
+	MirrorHost  string      `xml:"mirror_host,omitempty"`
+	MirrorPath  string      `xml:"mirror_path,omitempty"`
+	Nameservers []string    `xml:"nameservers>nameserver"`
+	Packages    []string    `xml:"packages>package"`
+	Vars        []DomainVar `xml:"template_vars>var"`
+}
+
+// Ansible host variable
+type DomainVar struct {
+	Name  string `xml:"name,attr" json:"name"`
+	Value string `xml:",chardata" json:"value"`
+}
+
+// Get our metadata from the domain. VMs created by older versions of lab-cli do not
+// have any, so an empty struct is returned in that case.
+func getDomainMetadata(domain *libvirt.Domain) (*DomainMetadata, error) {
+	metadata := &DomainMetadata{}
+
+	content, err := domain.GetMetadata(libvirt.DOMAIN_METADATA_ELEMENT, metadataURI, libvirt.DOMAIN_AFFECT_CURRENT)
+	if err != nil {
+		if lverr, ok := err.(libvirt.Error); ok && lverr.Code == libvirt.ERR_NO_DOMAIN_METADATA {
+			return metadata, nil
+		}
+
+		return nil, err
+	}
+
+	if err := xml.Unmarshal([]byte(content), metadata); err != nil {
+		return nil, &metadataParseError{err}
+	}
+
+	return metadata, nil
+}
+
+// Our metadata exists but is not something we can read, someone has edited it by hand
+type metadataParseError struct {
+	err error
+}
+
+func (e *metadataParseError) Error() string {
+	return fmt.Sprintf("the metadata can't be parsed: %s", e.err)
+}
+
+// Like getDomainMetadata, but metadata that can't be parsed is returned as a problem
+// together with empty metadata, for commands that should work with broken VMs as well
+func readDomainMetadata(domain *libvirt.Domain) (*DomainMetadata, string, error) {
+	metadata, err := getDomainMetadata(domain)
+	if err == nil {
+		return metadata, "", nil
+	}
+
+	if _, ok := err.(*metadataParseError); ok {
+		return &DomainMetadata{}, err.Error(), nil
+	}
+
+	return nil, "", err
+}
+
+// Save our metadata in the persistent configuration of the domain, and in the live
+// configuration as well if the domain is running.
+func setDomainMetadata(domain *libvirt.Domain, metadata *DomainMetadata) error {
+	content, err := xml.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+
+	err = domain.SetMetadata(libvirt.DOMAIN_METADATA_ELEMENT, string(content), metadataKey, metadataURI, libvirt.DOMAIN_AFFECT_CONFIG)
+	if err != nil {
+		return err
+	}
+
+	active, err := domain.IsActive()
+	if err != nil {
+		return err
+	}
+
+	if active {
+		err = domain.SetMetadata(libvirt.DOMAIN_METADATA_ELEMENT, string(content), metadataKey, metadataURI, libvirt.DOMAIN_AFFECT_LIVE)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// The install settings of create options, or nil if none were given
+func installMetadata(options *CreateOptions) *DomainInstall {
+	install := &DomainInstall{
+		Locale:      options.Install.Locale,
+		Keyboard:    options.Install.Keyboard,
+		Timezone:    options.Install.Timezone,
+		HTTPProxy:   options.Install.HTTPProxy,
+		MirrorHost:  options.MirrorHost,
+		MirrorPath:  options.MirrorPath,
+		Nameservers: options.Install.Nameservers,
+		Packages:    options.Install.Packages,
+		Vars:        sortedVars(options.Install.Vars),
+	}
+
+	if reflect.DeepEqual(install, &DomainInstall{}) {
+		return nil
+	}
+
+	return install
+}
+
+// Turn a list of variables back into a map
+func varsMap(vars []DomainVar) map[string]string {
+	m := make(map[string]string)
+	for _, v := range vars {
+		m[v.Name] = v.Value
+	}
+
+	return m
+}
+
+// Turn a map of variables into a list sorted by name
+func sortedVars(vars map[string]string) []DomainVar {
+	var names []string
+	for name := range vars {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var sorted []DomainVar
+	for _, name := range names {
+		sorted = append(sorted, DomainVar{Name: name, Value: vars[name]})
+	}
+
+	return sorted
+}
+
+// The description that marks a VM as ours, see parseDescription
+func formatDescription(address net.IP, groups []string) string {
+	return fmt.Sprintf("labcli:%s:%s", address, strings.Join(groups, ","))
+}
+
+// Replace the description of the domain with one for address and groups
+func setDomainDescription(domain *libvirt.Domain, address net.IP, groups []string) error {
+	return updateDomainMetadata(domain, libvirt.DOMAIN_METADATA_DESCRIPTION, formatDescription(address, groups), "", "")
+}
+
+// Remove our description and metadata element, the domain is no longer managed by lab-cli
+// after that. It gets back the description it had before, if any.
+func removeDomainMetadata(domain *libvirt.Domain, desc string) error {
+	if err := updateDomainMetadata(domain, libvirt.DOMAIN_METADATA_DESCRIPTION, desc, "", ""); err != nil {
+		return err
+	}
+
+	return updateDomainMetadata(domain, libvirt.DOMAIN_METADATA_ELEMENT, "", metadataKey, metadataURI)
+}
+
+// Set metadata in the persistent configuration, and in the live configuration as
+// well if the domain is running. An empty value removes it.
+func updateDomainMetadata(domain *libvirt.Domain, kind libvirt.DomainMetadataType, value string, key string, uri string) error {
+	err := domain.SetMetadata(kind, value, key, uri, libvirt.DOMAIN_AFFECT_CONFIG)
+	if err != nil {
+		return err
+	}
+
+	active, err := domain.IsActive()
+	if err != nil {
+		return err
+	}
+
+	if active {
+		return domain.SetMetadata(kind, value, key, uri, libvirt.DOMAIN_AFFECT_LIVE)
+	}
+
+	return nil
+}
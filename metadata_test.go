@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/xml"
+	"testing"
+	"time"
+)
+
+func TestMetadataRoundTrip(t *testing.T) {
+	created := time.Date(2020, 6, 15, 12, 0, 0, 0, time.UTC)
+	metadata := DomainMetadata{
+		Distro:           "centos",
+		CreatedAt:        &created,
+		Vars:             sortedVars(map[string]string{"env": "staging", "http_port": "8080"}),
+		KernelArgs:       []string{"debug", "net.ifnames=0"},
+		VirtInstallArgs:  []string{"--cpu", "host-passthrough"},
+		ConfigKernelArgs: []string{"quiet"},
+	}
+
+	content, err := xml.Marshal(metadata)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// libvirt adds the namespace when the metadata is read back
+	content = []byte(`<labcli xmlns="https://github.com/jagardaniel/lab-cli"` + string(content)[len("<labcli"):])
+
+	var parsed DomainMetadata
+	if err := xml.Unmarshal(content, &parsed); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if parsed.Distro != "centos" || !parsed.CreatedAt.Equal(created) {
+		t.Errorf("did not get the metadata we wanted. got: %+v", parsed)
+	}
+
+	if len(parsed.Vars) != 2 || parsed.Vars[0].Name != "env" || parsed.Vars[1].Value != "8080" {
+		t.Errorf("did not get the variables we wanted. got: %+v", parsed.Vars)
+	}
+
+	if len(parsed.KernelArgs) != 2 || parsed.KernelArgs[1] != "net.ifnames=0" || len(parsed.VirtInstallArgs) != 2 {
+		t.Errorf("did not get the arguments we wanted. got: %v, %v", parsed.KernelArgs, parsed.VirtInstallArgs)
+	}
+
+	if len(parsed.ConfigKernelArgs) != 1 || parsed.ConfigKernelArgs[0] != "quiet" {
+		t.Errorf("did not get the config kernel arguments we wanted. got: %v", parsed.ConfigKernelArgs)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+
+	libvirt "libvirt.org/libvirt-go"
+)
+
+// File that dnsmasq hands out to booting VMs. The iPXE ROM in QEMU runs it and
+// continues with the script for the MAC address, or boots from disk if there is none.
+const pxeBootFile = "boot.ipxe"
+
+const pxeBootScript = `#!ipxe
+chain ${mac:hexhyp}.ipxe || exit
+`
+
+type NetworkTFTP struct {
+	Root string `xml:"root,attr"`
+}
+
+type NetworkDHCP struct {
+	Hosts []DHCPHostXML `xml:"host"`
+	Bootp struct {
+		File string `xml:"file,attr"`
+	} `xml:"bootp"`
+}
+
+type DHCPHostXML struct {
+	XMLName xml.Name `xml:"host"`
+	MAC     string   `xml:"mac,attr"`
+	Name    string   `xml:"name,attr"`
+	IP      net.IP   `xml:"ip,attr"`
+}
+
+// Generate a MAC address in the range QEMU uses, so the DHCP host entry can be added before the VM exists
+func randomMAC() (string, error) {
+	mac := make([]byte, 3)
+	if _, err := rand.Read(mac); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("52:54:00:%02x:%02x:%02x", mac[0], mac[1], mac[2]), nil
+}
+
+// Check that the network was created with a TFTP root, otherwise nothing answers the PXE requests
+func checkPXENetwork(network *libvirt.Network, config *Config) error {
+	xmlDesc, err := network.GetXMLDesc(0)
+	if err != nil {
+		return err
+	}
+
+	var parsedNetwork NetworkXML
+	if err := xml.Unmarshal([]byte(xmlDesc), &parsedNetwork); err != nil {
+		return err
+	}
+
+	if parsedNetwork.IP.TFTP == nil || parsedNetwork.IP.DHCP == nil {
+		return fmt.Errorf("the network '%s' was created without PXE support. Remove it with 'virsh net-destroy %s' and 'virsh net-undefine %s' and lab-cli will create it again", config.Network.Name, config.Network.Name, config.Network.Name)
+	}
+
+	return nil
+}
+
+// Where the kernel and initrd for a network install are downloaded from (iPXE fetches
+// them directly), and extra kernel arguments the installer needs to find the rest of itself
+func pxeBootFiles(config *Config, distro string) (string, string, string, error) {
+	location := getDistroConfig(config, distro).Location
+
+	if !strings.HasPrefix(location, "http://") {
+		return "", "", "", fmt.Errorf("PXE installs need an http:// location for %s, got '%s'", distro, location)
+	}
+
+	location = strings.TrimSuffix(location, "/") + "/"
+
+	switch distro {
+	case "debian":
+		netboot := location + "current/images/netboot/debian-installer/amd64/"
+		return netboot + "linux", netboot + "initrd.gz", "", nil
+	case "centos":
+		return location + "images/pxeboot/vmlinuz", location + "images/pxeboot/initrd.img", "inst.stage2=" + location, nil
+	}
+
+	return "", "", "", fmt.Errorf("PXE installs are not supported for %s", distro)
+}
+
+// Write the iPXE script for a VM into the TFTP root, together with the script that all VMs boot
+func writePXEConfig(config *Config, distro string, mac string, kernelArgs string) error {
+	kernel, initrd, extraArgs, err := pxeBootFiles(config, distro)
+	if err != nil {
+		return err
+	}
+
+	if extraArgs != "" {
+		kernelArgs = fmt.Sprintf("%s %s", kernelArgs, extraArgs)
+	}
+
+	if err := os.MkdirAll(config.PXE.TFTPRoot, 0755); err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(path.Join(config.PXE.TFTPRoot, pxeBootFile), []byte(pxeBootScript), 0644); err != nil {
+		return err
+	}
+
+	script := fmt.Sprintf("#!ipxe\nkernel %s initrd=%s %s\ninitrd %s\nboot\n", kernel, path.Base(initrd), kernelArgs, initrd)
+
+	return os.WriteFile(pxeConfigFile(config, mac), []byte(script), 0644)
+}
+
+func pxeConfigFile(config *Config, mac string) string {
+	return path.Join(config.PXE.TFTPRoot, strings.ReplaceAll(strings.ToLower(mac), ":", "-")+".ipxe")
+}
+
+// Write the boot script for the VM and give it its address over DHCP, which is needed to boot from the network
+func preparePXE(conn *libvirt.Connect, config *Config, options *CreateOptions, mac string, address net.IP, kernelArgs string) error {
+	if err := writePXEConfig(config, options.Distro, mac, kernelArgs); err != nil {
+		return err
+	}
+
+	network, err := getNetwork(conn, config)
+	if err != nil {
+		return err
+	}
+	defer network.Free()
+
+	return updateDHCPHost(network, libvirt.NETWORK_UPDATE_COMMAND_ADD_LAST, mac, options.Name, address)
+}
+
+// Remove the PXE config and DHCP host entry for a VM, if it was installed with PXE
+func removePXEConfig(conn *libvirt.Connect, config *Config, mac string, name string, address net.IP) error {
+	file := pxeConfigFile(config, mac)
+
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		return nil
+	}
+
+	network, err := getNetwork(conn, config)
+	if err != nil {
+		return err
+	}
+	defer network.Free()
+
+	err = updateDHCPHost(network, libvirt.NETWORK_UPDATE_COMMAND_DELETE, mac, name, address)
+	if err != nil && !strings.Contains(err.Error(), "couldn't locate") {
+		return err
+	}
+
+	return os.Remove(file)
+}
+
+func updateDHCPHost(network *libvirt.Network, command libvirt.NetworkUpdateCommand, mac string, name string, address net.IP) error {
+	return updateNetwork(network, command, libvirt.NETWORK_SECTION_IP_DHCP_HOST, DHCPHostXML{MAC: mac, Name: name, IP: address})
+}
+
+// Change a section of the network, in the running network as well if it is active
+func updateNetwork(network *libvirt.Network, command libvirt.NetworkUpdateCommand, section libvirt.NetworkUpdateSection, entry interface{}) error {
+	xmlData, err := xml.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	flags := libvirt.NETWORK_UPDATE_AFFECT_CONFIG
+
+	active, err := network.IsActive()
+	if err != nil {
+		return err
+	}
+
+	if active {
+		flags |= libvirt.NETWORK_UPDATE_AFFECT_LIVE
+	}
+
+	return network.Update(command, section, -1, string(xmlData), flags)
+}
+
+// The MAC addresses of the domain
+func getDomainMACs(domain *libvirt.Domain) ([]string, error) {
+	type DomainXML struct {
+		Interfaces []struct {
+			MAC struct {
+				Address string `xml:"address,attr"`
+			} `xml:"mac"`
+		} `xml:"devices>interface"`
+	}
+
+	xmlDesc, err := domain.GetXMLDesc(0)
+	if err != nil {
+		return nil, err
+	}
+
+	var parsedDomain DomainXML
+	if err := xml.Unmarshal([]byte(xmlDesc), &parsedDomain); err != nil {
+		return nil, err
+	}
+
+	var macs []string
+	for _, iface := range parsedDomain.Interfaces {
+		macs = append(macs, iface.MAC.Address)
+	}
+
+	return macs, nil
+}
+
+func validatePXE(config *Config, distro string) error {
+	if config.PXE.TFTPRoot == "" {
+		return errors.New("pxe.tftp_root is empty")
+	}
+
+	_, _, _, err := pxeBootFiles(config, distro)
+
+	return err
+}
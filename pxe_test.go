@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/xml"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestRandomMAC(t *testing.T) {
+	mac, err := randomMAC()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !regexp.MustCompile(`^52:54:00(:[0-9a-f]{2}){3}$`).MatchString(mac) {
+		t.Errorf("not a QEMU MAC address: %s", mac)
+	}
+}
+
+func TestWritePXEConfig(t *testing.T) {
+	config := defaultConfig
+	config.PXE.TFTPRoot = t.TempDir()
+
+	err := writePXEConfig(&config, "centos", "52:54:00:AB:cd:01", "inst.ks=http://192.168.100.1/x/kickstart.cfg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(path.Join(config.PXE.TFTPRoot, pxeBootFile)); err != nil {
+		t.Errorf("the boot script was not written: %s", err)
+	}
+
+	data, err := os.ReadFile(path.Join(config.PXE.TFTPRoot, "52-54-00-ab-cd-01.ipxe"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	location := config.Centos.Location
+	want := "#!ipxe\nkernel " + location + "images/pxeboot/vmlinuz initrd=initrd.img inst.ks=http://192.168.100.1/x/kickstart.cfg inst.stage2=" + location + "\ninitrd " + location + "images/pxeboot/initrd.img\nboot\n"
+
+	if string(data) != want {
+		t.Errorf("did not get the script we wanted. got:\n%s\nwant:\n%s", data, want)
+	}
+
+	// Ubuntu needs the whole ISO
+	if err := validatePXE(&config, "ubuntu"); err == nil {
+		t.Error("PXE installs of ubuntu should not be possible")
+	}
+}
+
+func TestNetworkXMLPXE(t *testing.T) {
+	data := NetworkXML{Name: "lab"}
+	data.IP.TFTP = &NetworkTFTP{Root: "/var/lib/lab-cli/tftp"}
+	data.IP.DHCP = &NetworkDHCP{}
+	data.IP.DHCP.Bootp.File = pxeBootFile
+
+	xmlData, err := xml.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(string(xmlData), `<tftp root="/var/lib/lab-cli/tftp"></tftp><dhcp><bootp file="boot.ipxe"></bootp></dhcp>`) {
+		t.Errorf("did not get the network XML we wanted. got: %s", xmlData)
+	}
+
+	// Without PXE the elements should not be there at all
+	xmlData, err = xml.Marshal(NetworkXML{Name: "lab"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(xmlData), "tftp") || strings.Contains(string(xmlData), "dhcp") {
+		t.Errorf("the network XML should not have PXE settings. got: %s", xmlData)
+	}
+}
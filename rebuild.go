@@ -0,0 +1,403 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	libvirt "libvirt.org/libvirt-go"
+)
+
+type RebuildOptions struct {
+	Name    string
+	Distro  string
+	Yes     bool
+	Console bool
+	NoWait  bool
+}
+
+// Install a VM again on a new system disk. It keeps its name, address, MAC address, groups,
+// variables, passwords and data disks, everything else is created the way it was the first time.
+func rebuildCommand(args []string, config *Config) error {
+	// Parse arguments
+	rebuild, err := parseRebuild(args)
+	if err != nil {
+		return err
+	}
+
+	// Create a libvirt connection
+	conn, err := libvirt.NewConnect("qemu:///system")
+	if err != nil {
+		return err
+	}
+
+	domain, err := getExistingDomain(conn, rebuild.Name)
+	if err != nil {
+		return err
+	}
+
+	summary, err := getDomainSummary(domain)
+	if err != nil {
+		return err
+	}
+
+	if err := summary.Err(); err != nil {
+		return err
+	}
+
+	metadata, err := getDomainMetadata(domain)
+	if err != nil {
+		return err
+	}
+
+	info, err := domain.GetInfo()
+	if err != nil {
+		return err
+	}
+
+	disk, err := getSystemDiskSize(conn, domain, metadata)
+	if err != nil {
+		return err
+	}
+
+	options := rebuildCreateOptions(summary, metadata, int(info.MaxMem/1024), int(info.NrVirtCpu), disk)
+	options.Console = rebuild.Console
+	options.NoWait = rebuild.NoWait
+
+	// The kernel arguments from the config of another distro don't belong to the new one
+	if rebuild.Distro != "" && rebuild.Distro != options.Distro {
+		options.ConfigKernelArgs = nil
+	}
+
+	if rebuild.Distro != "" {
+		options.Distro = rebuild.Distro
+	}
+
+	if options.Distro == "" {
+		return fmt.Errorf("the distro of '%s' is not known, give it with --distro", rebuild.Name)
+	}
+
+	disks, err := getDomainDisks(domain)
+	if err != nil {
+		return err
+	}
+
+	// The data disks are attached to the new VM as they are
+	var detached []string
+	options.ExtraDisks, detached = keptExtraDisks(disks, metadata.ExtraDisks)
+
+	// A disk whose volume is gone is created again
+	for i, disk := range options.ExtraDisks {
+		if disk.Path == "" {
+			continue
+		}
+
+		volume, err := conn.LookupStorageVolByPath(disk.Path)
+		if err != nil {
+			if !strings.Contains(err.Error(), "Storage volume not found") {
+				return err
+			}
+
+			options.ExtraDisks[i].Path = ""
+			continue
+		}
+		volume.Free()
+	}
+
+	macs, err := getDomainMACs(domain)
+	if err != nil {
+		return err
+	}
+
+	if len(macs) > 0 {
+		options.MAC = macs[0]
+	}
+
+	secrets, err := loadSecrets()
+	if err != nil {
+		return err
+	}
+
+	if secret, exists := secrets[rebuild.Name]; exists {
+		options.Secrets = &secret
+	}
+
+	// Enough to create the VM by hand if the installation fails after the old VM is gone
+	createArgs := shellJoin(append([]string{"lab-cli"}, createArguments(options)...))
+
+	// Everything that can be checked is checked before the old VM is removed
+	if _, err := prepareCreate(conn, config, options); err != nil {
+		return err
+	}
+
+	if !rebuild.Yes {
+		plan := fmt.Sprintf("This removes '%s' with its system disk and snapshots and installs it again with %s\n", rebuild.Name, options.Address)
+
+		for _, disk := range options.ExtraDisks {
+			if disk.Path != "" {
+				plan += fmt.Sprintf("The data disk %s is kept and attached again\n", disk.Path)
+			}
+		}
+
+		for _, file := range detached {
+			plan += fmt.Sprintf("The disk %s is kept but not attached, lab-cli doesn't know it\n", file)
+		}
+
+		plan += fmt.Sprintf("The same as: %s\n", createArgs)
+
+		confirmed, err := confirm(plan)
+		if err != nil {
+			return err
+		}
+
+		if !confirmed {
+			fmt.Println("Nothing was changed")
+			return nil
+		}
+	}
+
+	err = removeDomain(conn, config, domain, rebuild.Name, keepDataDisks, true)
+	if err != nil {
+		return err
+	}
+
+	// The new installation has new host keys
+	knownHosts, err := getKnownHostsFile()
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(knownHosts); err == nil {
+		if err := removeKnownHost(knownHosts, options.Address.String()); err != nil {
+			return err
+		}
+	}
+
+	err = createVM(config, options)
+	if err != nil {
+		var kept []string
+		for _, disk := range options.ExtraDisks {
+			if disk.Path != "" {
+				kept = append(kept, disk.Path)
+			}
+		}
+
+		if len(kept) > 0 {
+			err = fmt.Errorf("%s\nThe data disks are still in the pool: %s", err, strings.Join(kept, ", "))
+		}
+
+		return fmt.Errorf("%s\nThe old VM has been removed. Create it again with: %s", err, createArgs)
+	}
+
+	for _, file := range detached {
+		fmt.Printf("The disk %s was not attached to the new VM, it is still in the pool\n", file)
+	}
+
+	return nil
+}
+
+// The extra disks of a VM with the volumes they have now, found by their serial number.
+// The other disks after the system disk are returned as well, they are kept but not attached.
+func keptExtraDisks(disks []DomainDisk, extraDisks []ExtraDisk) ([]ExtraDisk, []string) {
+	kept := append([]ExtraDisk(nil), extraDisks...)
+
+	var detached []string
+
+	for i, disk := range disks {
+		if i == 0 {
+			continue
+		}
+
+		found := false
+		for j := range kept {
+			if kept[j].Path == "" && disk.Serial != "" && kept[j].Name == disk.Serial {
+				kept[j].Path = disk.Source.File
+				found = true
+				break
+			}
+		}
+
+		if !found && disk.Source.File != "" {
+			detached = append(detached, disk.Source.File)
+		}
+	}
+
+	return kept, detached
+}
+
+// Size of the first disk in GB, or the size it was created with if the volume is gone
+func getSystemDiskSize(conn *libvirt.Connect, domain *libvirt.Domain, metadata *DomainMetadata) (int, error) {
+	disks, err := getDomainDisks(domain)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(disks) > 0 {
+		volume, err := conn.LookupStorageVolByPath(disks[0].Source.File)
+		if err == nil {
+			defer volume.Free()
+
+			volumeInfo, err := volume.GetInfo()
+			if err != nil {
+				return 0, err
+			}
+
+			// Round up, the disk must not get smaller
+			gb := uint64(1024 * 1024 * 1024)
+			return int((volumeInfo.Capacity + gb - 1) / gb), nil
+		}
+	}
+
+	if metadata.Disk > 0 {
+		return metadata.Disk, nil
+	}
+
+	return 0, errors.New("the size of the system disk is not known since its volume is missing")
+}
+
+// Create options for a VM like the one described by summary and metadata. RAM, VCPUs
+// and disk are what the VM has now, so a resize is kept.
+func rebuildCreateOptions(summary *DomainSummary, metadata *DomainMetadata, ram int, vcpus int, disk int) *CreateOptions {
+	var groups []string
+	for _, group := range summary.Groups {
+		if group != "" {
+			groups = append(groups, group)
+		}
+	}
+
+	options := &CreateOptions{
+		Name:            summary.Name,
+		Distro:          metadata.Distro,
+		RAM:             ram,
+		VCPUs:           vcpus,
+		Disk:            disk,
+		DiskFormat:      metadata.DiskFormat,
+		DiskBus:         metadata.DiskBus,
+		ExtraDisks:      metadata.ExtraDisks,
+		Groups:          groups,
+		Vars:            varsMap(metadata.Vars),
+		KernelArgs:      metadata.KernelArgs,
+		VirtInstallArgs: metadata.VirtInstallArgs,
+		Address:         summary.Address,
+	}
+
+	// VMs created before they were saved get the ones the config has now
+	options.ConfigKernelArgs = metadata.ConfigKernelArgs
+
+	if install := metadata.Install; install != nil {
+		options.Install = InstallConfig{
+			Locale:      install.Locale,
+			Keyboard:    install.Keyboard,
+			Timezone:    install.Timezone,
+			HTTPProxy:   install.HTTPProxy,
+			Nameservers: install.Nameservers,
+			Packages:    install.Packages,
+			Vars:        varsMap(install.Vars),
+		}
+		options.MirrorHost = install.MirrorHost
+		options.MirrorPath = install.MirrorPath
+	}
+
+	return options
+}
+
+// The arguments for create that give a VM like options, except for the MAC address
+func createArguments(options *CreateOptions) []string {
+	args := []string{
+		"create",
+		"--distro", options.Distro,
+		"--ram", strconv.Itoa(options.RAM),
+		"--vcpus", strconv.Itoa(options.VCPUs),
+		"--disk", strconv.Itoa(options.Disk),
+	}
+
+	if options.Address != nil {
+		args = append(args, "--ip", options.Address.String())
+	}
+
+	if len(options.Groups) > 0 {
+		args = append(args, "--groups", strings.Join(options.Groups, ","))
+	}
+
+	for _, v := range sortedVars(options.Vars) {
+		args = append(args, "--var", v.Name+"="+v.Value)
+	}
+
+	if options.DiskFormat != "" {
+		args = append(args, "--disk-format", options.DiskFormat)
+	}
+
+	if options.DiskBus != "" {
+		args = append(args, "--disk-bus", options.DiskBus)
+	}
+
+	for _, disk := range options.ExtraDisks {
+		args = append(args, "--extra-disk", fmt.Sprintf("size=%d,name=%s", disk.Size, disk.Name))
+	}
+
+	for _, arg := range options.KernelArgs {
+		args = append(args, "--kernel-arg", arg)
+	}
+
+	// With = since the values start with dashes
+	for _, arg := range options.VirtInstallArgs {
+		args = append(args, "--virt-install-arg="+arg)
+	}
+
+	settings := []struct {
+		flag  string
+		value string
+	}{
+		{"--locale", options.Install.Locale},
+		{"--keyboard", options.Install.Keyboard},
+		{"--timezone", options.Install.Timezone},
+		{"--proxy", options.Install.HTTPProxy},
+		{"--mirror-host", options.MirrorHost},
+		{"--mirror-path", options.MirrorPath},
+		{"--nameservers", strings.Join(options.Install.Nameservers, ",")},
+		{"--packages", strings.Join(options.Install.Packages, ",")},
+	}
+
+	for _, setting := range settings {
+		if setting.value != "" {
+			args = append(args, setting.flag, setting.value)
+		}
+	}
+
+	for _, v := range sortedVars(options.Install.Vars) {
+		args = append(args, "--template-var", v.Name+"="+v.Value)
+	}
+
+	return append(args, options.Name)
+}
+
+func parseRebuild(args []string) (*RebuildOptions, error) {
+	command := flag.NewFlagSet("rebuild", flag.ExitOnError)
+	distro := command.String("distro", "", "distribution to install, for VMs that lab-cli doesn't know the distribution of")
+	yes := command.Bool("yes", false, "rebuild the VM without asking for confirmation")
+	console := command.Bool("console", false, "attach to the serial console during the installation")
+	noWait := command.Bool("no-wait", false, "return as soon as the installation has started")
+
+	command.Parse(args[2:])
+
+	if len(command.Args()) < 1 {
+		return nil, errors.New("rebuild subcommand requires a name")
+	}
+
+	if *distro != "" && !isDistro(*distro) {
+		return nil, fmt.Errorf("selected distribution is not available, use one of: %s", strings.Join(distros, ", "))
+	}
+
+	options := &RebuildOptions{
+		Name:    command.Args()[0],
+		Distro:  *distro,
+		Yes:     *yes,
+		Console: *console,
+		NoWait:  *noWait,
+	}
+
+	return options, nil
+}
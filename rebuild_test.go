@@ -0,0 +1,179 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestRebuildCreateOptions(t *testing.T) {
+	summary := &DomainSummary{
+		Name:    "web01",
+		Address: net.ParseIP("192.168.100.12").To4(),
+		Groups:  []string{"web", ""},
+	}
+
+	metadata := &DomainMetadata{
+		Distro:           "centos",
+		Vars:             []DomainVar{{Name: "role", Value: "frontend"}},
+		KernelArgs:       []string{"console=ttyS0"},
+		ConfigKernelArgs: []string{"quiet"},
+		VirtInstallArgs:  []string{"--cpu=host"},
+		DiskFormat:       "raw",
+		DiskBus:          "scsi",
+		ExtraDisks:       []ExtraDisk{{Name: "data", Size: 5}},
+		Disk:             10,
+		Install: &DomainInstall{
+			Timezone:    "Europe/Berlin",
+			MirrorHost:  "mirror.example.com",
+			Nameservers: []string{"1.1.1.1", "9.9.9.9"},
+			Packages:    []string{"vim"},
+			Vars:        []DomainVar{{Name: "swap", Value: "2G"}},
+		},
+	}
+
+	options := rebuildCreateOptions(summary, metadata, 4096, 4, 20)
+
+	want := &CreateOptions{
+		Name:            "web01",
+		Distro:          "centos",
+		RAM:             4096,
+		VCPUs:           4,
+		Disk:            20,
+		DiskFormat:      "raw",
+		DiskBus:         "scsi",
+		ExtraDisks:      []ExtraDisk{{Name: "data", Size: 5}},
+		Groups:          []string{"web"},
+		Vars:            map[string]string{"role": "frontend"},
+		KernelArgs:      []string{"console=ttyS0"},
+		VirtInstallArgs: []string{"--cpu=host"},
+		Install: InstallConfig{
+			Timezone:    "Europe/Berlin",
+			Nameservers: []string{"1.1.1.1", "9.9.9.9"},
+			Packages:    []string{"vim"},
+			Vars:        map[string]string{"swap": "2G"},
+		},
+		MirrorHost:       "mirror.example.com",
+		Address:          net.ParseIP("192.168.100.12").To4(),
+		ConfigKernelArgs: []string{"quiet"},
+	}
+
+	if !reflect.DeepEqual(options, want) {
+		t.Errorf("got %+v, want %+v", options, want)
+	}
+
+	// The arguments must give the same options to create, apart from what rebuild sets itself
+	parsed, err := parseCreate(append([]string{"lab-cli"}, createArguments(options)...))
+	if err != nil {
+		t.Fatalf("create arguments %v can't be parsed: %v", createArguments(options), err)
+	}
+
+	parsed.ConfigKernelArgs = options.ConfigKernelArgs
+
+	if !reflect.DeepEqual(parsed, options) {
+		t.Errorf("got %+v from the create arguments, want %+v", parsed, options)
+	}
+}
+
+func TestCreateArguments(t *testing.T) {
+	options := &CreateOptions{
+		Name:   "db01",
+		Distro: "debian",
+		RAM:    2048,
+		VCPUs:  2,
+		Disk:   10,
+		Groups: []string{"db", "backup"},
+		Vars:   map[string]string{"b": "2", "a": "1"},
+	}
+
+	want := []string{
+		"create", "--distro", "debian", "--ram", "2048", "--vcpus", "2", "--disk", "10",
+		"--groups", "db,backup", "--var", "a=1", "--var", "b=2", "db01",
+	}
+
+	if args := createArguments(options); !reflect.DeepEqual(args, want) {
+		t.Errorf("got %v, want %v", args, want)
+	}
+}
+
+func TestParseRebuild(t *testing.T) {
+	var tests = []struct {
+		args  []string
+		want  *RebuildOptions
+		valid bool
+	}{
+		{[]string{"lab-cli", "rebuild", "web01"}, &RebuildOptions{Name: "web01"}, true},
+		{
+			[]string{"lab-cli", "rebuild", "--yes", "--distro", "ubuntu", "--no-wait", "web01"},
+			&RebuildOptions{Name: "web01", Distro: "ubuntu", Yes: true, NoWait: true},
+			true,
+		},
+		{[]string{"lab-cli", "rebuild", "--distro", "nope", "web01"}, nil, false},
+		{[]string{"lab-cli", "rebuild"}, nil, false},
+	}
+
+	for _, test := range tests {
+		options, err := parseRebuild(test.args)
+		if (err == nil) != test.valid {
+			t.Errorf("unexpected result for %v: %v", test.args, err)
+			continue
+		}
+
+		if test.valid && !reflect.DeepEqual(options, test.want) {
+			t.Errorf("got %+v for %v, want %+v", options, test.args, test.want)
+		}
+	}
+}
+
+func TestKeptExtraDisks(t *testing.T) {
+	var system, data, logs, other DomainDisk
+	system.Source.File = "/pool/web01.qcow2"
+	data.Source.File = "/pool/web01-data.qcow2"
+	data.Serial = "data"
+	logs.Source.File = "/pool/web01-logs.qcow2"
+	logs.Serial = "logs"
+	other.Source.File = "/pool/scratch.img"
+
+	extraDisks := []ExtraDisk{{Name: "logs", Size: 5}, {Name: "data", Size: 20}, {Name: "cache", Size: 1}}
+
+	kept, detached := keptExtraDisks([]DomainDisk{system, data, other, logs}, extraDisks)
+
+	want := []ExtraDisk{
+		{Name: "logs", Size: 5, Path: "/pool/web01-logs.qcow2"},
+		{Name: "data", Size: 20, Path: "/pool/web01-data.qcow2"},
+		{Name: "cache", Size: 1},
+	}
+
+	if !reflect.DeepEqual(kept, want) {
+		t.Errorf("got %+v, want %+v", kept, want)
+	}
+
+	if want := []string{"/pool/scratch.img"}; !reflect.DeepEqual(detached, want) {
+		t.Errorf("got %v detached, want %v", detached, want)
+	}
+
+	if extraDisks[0].Path != "" {
+		t.Error("the extra disks of the metadata were changed")
+	}
+}
+
+func TestRebuildKeepsDataDisks(t *testing.T) {
+	var system, data DomainDisk
+	system.Source.File = "/pool/web01.qcow2"
+	data.Source.File = "/pool/web01-data.img"
+	data.Serial = "data"
+
+	kept, _ := keptExtraDisks([]DomainDisk{system, data}, []ExtraDisk{{Name: "data", Size: 20}})
+	options := &CreateOptions{Name: "web01", Disk: 10, ExtraDisks: kept}
+
+	// create makes the volumes without a path and only those are deleted by its rollback
+	for _, volume := range diskVolumes(options) {
+		if volume.Serial != "data" {
+			continue
+		}
+
+		if volume.Path != data.Source.File || volume.Format != "" || volume.Name != "" {
+			t.Errorf("the kept data disk would be created again: %+v", volume)
+		}
+	}
+}
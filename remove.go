@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bufio"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+	libvirt "libvirt.org/libvirt-go"
+)
+
+type RemoveOptions struct {
+	Name      string
+	KeepDisks bool
+	Yes       bool
+}
+
+// Everything that is removed together with a VM
+type removePlan struct {
+	State string
+	Disks []string
+	// Images that another VM uses as well, they are kept
+	Shared    []string
+	Snapshots []string
+	NVRAM     string
+}
+
+// Remove a VM with its disks, snapshots, NVRAM, PXE config and secrets. The domain is
+// undefined last, so if something fails on the way remove can be run again to finish the job.
+func removeCommand(args []string, config *Config) error {
+	// Parse arguments
+	options, err := parseRemove(args)
+	if err != nil {
+		return err
+	}
+
+	// Create a libvirt connection
+	conn, err := libvirt.NewConnect("qemu:///system")
+	if err != nil {
+		return err
+	}
+
+	domain, err := getExistingDomain(conn, options.Name)
+	if err != nil {
+		return err
+	}
+
+	plan, err := getRemovePlan(conn, domain, options)
+	if err != nil {
+		return err
+	}
+
+	if !options.Yes {
+		confirmed, err := confirm(formatRemovePlan(options, plan))
+		if err != nil {
+			return err
+		}
+
+		if !confirmed {
+			fmt.Println("Nothing was removed")
+			return nil
+		}
+	}
+
+	var keepDisk func(int) bool
+	if options.KeepDisks {
+		keepDisk = keepAllDisks
+	}
+
+	err = removeDomain(conn, config, domain, options.Name, keepDisk, false)
+	if err != nil {
+		return err
+	}
+
+	if options.KeepDisks {
+		fmt.Printf("'%s' has been removed, the disks were kept:\n", options.Name)
+		for _, disk := range plan.Disks {
+			fmt.Printf("  %s\n", disk)
+		}
+
+		return nil
+	}
+
+	fmt.Printf("'%s' has been removed\n", options.Name)
+
+	return nil
+}
+
+// Keep every disk of a domain, or every disk except the system disk
+func keepAllDisks(index int) bool  { return true }
+func keepDataDisks(index int) bool { return index > 0 }
+
+// Destroy a domain and remove it with its snapshots, disks and PXE config. The disks that
+// keepDisk returns true for are left alone, nil removes all of them. The domain is
+// undefined last, so if something fails on the way it can be run again.
+func removeDomain(conn *libvirt.Connect, config *Config, domain *libvirt.Domain, name string, keepDisk func(index int) bool, keepSecrets bool) error {
+	// Needed to remove the PXE config
+	summary, err := getDomainSummary(domain)
+	if err != nil {
+		return err
+	}
+
+	macs, err := getDomainMACs(domain)
+	if err != nil {
+		return err
+	}
+
+	// Force stop the VM if it is running
+	active, err := domain.IsActive()
+	if err != nil {
+		return err
+	}
+
+	if active {
+		err = domain.DestroyFlags(libvirt.DOMAIN_DESTROY_DEFAULT)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = deleteSnapshots(domain)
+	if err != nil {
+		return err
+	}
+
+	// We need a way to remove the VM disks and we can't do it manually because
+	// of the the file permission. Find the disk paths in the VMs XML configuration,
+	// then find the volume objects by the disk paths and remove them.
+	disks, err := getDomainDisks(domain)
+	if err != nil {
+		return err
+	}
+
+	var deleted []DomainDisk
+	for i, disk := range disks {
+		if keepDisk == nil || !keepDisk(i) {
+			deleted = append(deleted, disk)
+		}
+	}
+
+	if len(deleted) > 0 {
+		err = deleteDiskVolumes(conn, deleted)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, mac := range macs {
+		err = removePXEConfig(conn, config, mac, name, summary.Address)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The passwords are useless without the VM
+	if !keepSecrets {
+		err = storeSecrets(name, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Remove the VM, the flags make libvirt remove the NVRAM file and a saved state as well
+	err = domain.UndefineFlags(libvirt.DOMAIN_UNDEFINE_NVRAM | libvirt.DOMAIN_UNDEFINE_MANAGED_SAVE |
+		libvirt.DOMAIN_UNDEFINE_SNAPSHOTS_METADATA)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func getRemovePlan(conn *libvirt.Connect, domain *libvirt.Domain, options *RemoveOptions) (*removePlan, error) {
+	type DomainXML struct {
+		NVRAM string `xml:"os>nvram"`
+	}
+
+	plan := &removePlan{State: "stopped"}
+
+	active, err := domain.IsActive()
+	if err != nil {
+		return nil, err
+	}
+
+	if active {
+		plan.State = "running"
+	}
+
+	disks, err := getDomainDisks(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	used, err := getUsedDiskFiles(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, disk := range disks {
+		files, err := getDiskFiles(conn, disk)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, file := range files {
+			if used[file] > 1 {
+				plan.Shared = append(plan.Shared, file)
+			} else {
+				plan.Disks = append(plan.Disks, file)
+			}
+		}
+	}
+
+	snapshots, err := domain.ListAllSnapshots(0)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, snapshot := range snapshots {
+		name, err := snapshot.GetName()
+		snapshot.Free()
+
+		if err != nil {
+			return nil, err
+		}
+
+		plan.Snapshots = append(plan.Snapshots, name)
+	}
+
+	xmlDesc, err := domain.GetXMLDesc(0)
+	if err != nil {
+		return nil, err
+	}
+
+	var parsedDomain DomainXML
+	if err := xml.Unmarshal([]byte(xmlDesc), &parsedDomain); err != nil {
+		return nil, err
+	}
+
+	plan.NVRAM = parsedDomain.NVRAM
+
+	return plan, nil
+}
+
+// Show what is about to happen and ask the user to confirm it
+func confirm(plan string) (bool, error) {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return false, errors.New("not asking for confirmation without a terminal, use --yes to go ahead anyway")
+	}
+
+	fmt.Print(plan)
+	fmt.Print("Continue? [y/N] ")
+
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false, err
+	}
+
+	answer = strings.ToLower(strings.TrimSpace(answer))
+
+	return answer == "y" || answer == "yes", nil
+}
+
+func formatRemovePlan(options *RemoveOptions, plan *removePlan) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "This removes the VM '%s' (%s)\n", options.Name, plan.State)
+
+	for _, disk := range plan.Disks {
+		if options.KeepDisks {
+			fmt.Fprintf(&b, "  keep disk:       %s\n", disk)
+		} else {
+			fmt.Fprintf(&b, "  delete disk:     %s\n", disk)
+		}
+	}
+
+	for _, disk := range plan.Shared {
+		fmt.Fprintf(&b, "  keep disk:       %s (used by another VM)\n", disk)
+	}
+
+	for _, snapshot := range plan.Snapshots {
+		fmt.Fprintf(&b, "  delete snapshot: %s\n", snapshot)
+	}
+
+	if plan.NVRAM != "" {
+		fmt.Fprintf(&b, "  delete NVRAM:    %s\n", plan.NVRAM)
+	}
+
+	return b.String()
+}
+
+// Delete all snapshots of a domain. External snapshots can't be deleted by libvirt,
+// only their metadata is removed and the overlay files are deleted with the disks.
+func deleteSnapshots(domain *libvirt.Domain) error {
+	snapshots, err := domain.ListAllSnapshots(0)
+	if err != nil {
+		return err
+	}
+
+	for _, snapshot := range snapshots {
+		err := snapshot.Delete(0)
+		if err != nil {
+			err = snapshot.Delete(libvirt.DOMAIN_SNAPSHOT_DELETE_METADATA_ONLY)
+		}
+
+		// Already removed by someone else
+		if err != nil && !strings.Contains(err.Error(), "Domain snapshot not found") {
+			snapshot.Free()
+			return err
+		}
+
+		snapshot.Free()
+	}
+
+	return nil
+}
+
+func parseRemove(args []string) (*RemoveOptions, error) {
+	command := flag.NewFlagSet("remove", flag.ExitOnError)
+	keepDisks := command.Bool("keep-disks", false, "keep the disk volumes of the VM")
+	yes := command.Bool("yes", false, "remove the VM without asking for confirmation")
+
+	command.Parse(args[2:])
+
+	if len(command.Args()) < 1 {
+		return nil, errors.New("remove subcommand requires a name")
+	}
+
+	options := &RemoveOptions{
+		Name:      command.Args()[0],
+		KeepDisks: *keepDisks,
+		Yes:       *yes,
+	}
+
+	return options, nil
+}
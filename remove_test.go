@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/xml"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiskFiles(t *testing.T) {
+	// A disk after an external snapshot
+	data := `<disk type="file" device="disk">
+  <source file="/var/lib/libvirt/images/lab01.snap1"/>
+  <target dev="vda"/>
+  <backingStore type="file">
+    <source file="/var/lib/libvirt/images/lab01.qcow2"/>
+    <backingStore/>
+  </backingStore>
+</disk>`
+
+	var disk DomainDisk
+	if err := xml.Unmarshal([]byte(data), &disk); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"/var/lib/libvirt/images/lab01.snap1", "/var/lib/libvirt/images/lab01.qcow2"}
+	if got := diskFiles(disk); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestFormatRemovePlan(t *testing.T) {
+	plan := &removePlan{
+		State:     "running",
+		Disks:     []string{"/var/lib/libvirt/images/lab01.qcow2"},
+		Shared:    []string{"/var/lib/libvirt/images/template.qcow2"},
+		Snapshots: []string{"before-upgrade"},
+		NVRAM:     "/var/lib/libvirt/qemu/nvram/lab01_VARS.fd",
+	}
+
+	out := formatRemovePlan(&RemoveOptions{Name: "lab01"}, plan)
+	for _, line := range []string{"'lab01' (running)", "delete disk:     /var/lib/libvirt/images/lab01.qcow2", "keep disk:       /var/lib/libvirt/images/template.qcow2 (used by another VM)", "delete snapshot: before-upgrade", "delete NVRAM:"} {
+		if !strings.Contains(out, line) {
+			t.Errorf("'%s' is missing in:\n%s", line, out)
+		}
+	}
+
+	out = formatRemovePlan(&RemoveOptions{Name: "lab01", KeepDisks: true}, plan)
+	if !strings.Contains(out, "keep disk:       /var/lib/libvirt/images/lab01.qcow2\n") || strings.Contains(out, "delete disk:") {
+		t.Errorf("the disks should be kept:\n%s", out)
+	}
+}
+
+func TestParseRemove(t *testing.T) {
+	options, err := parseRemove([]string{"lab-cli", "remove", "--keep-disks", "--yes", "lab01"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &RemoveOptions{Name: "lab01", KeepDisks: true, Yes: true}
+	if !reflect.DeepEqual(options, want) {
+		t.Errorf("got %+v, want %+v", options, want)
+	}
+
+	if _, err := parseRemove([]string{"lab-cli", "remove"}); err == nil {
+		t.Error("expected an error without a name")
+	}
+}
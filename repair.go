@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+
+	libvirt "libvirt.org/libvirt-go"
+)
+
+type RepairOptions struct {
+	Name   string
+	IP     net.IP
+	Groups []string
+	// Whether --groups was given, an empty value removes all groups
+	SetGroups bool
+}
+
+// Rewrite the description of a VM, and reset its metadata if it can't be parsed. Only
+// what lab-cli knows about the VM is changed, not the network configuration inside it.
+func repairCommand(args []string, config *Config) error {
+	// Parse arguments
+	options, err := parseRepair(args)
+	if err != nil {
+		return err
+	}
+
+	// Create a libvirt connection
+	conn, err := libvirt.NewConnect("qemu:///system")
+	if err != nil {
+		return err
+	}
+
+	domain, err := getExistingDomain(conn, options.Name)
+	if err != nil {
+		return err
+	}
+
+	summary, err := getDomainSummary(domain)
+	if err != nil {
+		return err
+	}
+
+	_, metadataProblem, err := readDomainMetadata(domain)
+	if err != nil {
+		return err
+	}
+
+	address := summary.Address
+	groups := summary.Groups
+
+	if summary.Problem != "" {
+		if options.IP == nil {
+			return fmt.Errorf("the address of '%s' can't be read (%s), give it with --ip", options.Name, summary.Problem)
+		}
+
+		groups = nil
+	}
+
+	if options.IP != nil {
+		mask := net.IPMask(config.Network.Netmask.To4())
+		subnet := &net.IPNet{IP: config.Network.Address.Mask(mask), Mask: mask}
+
+		if !subnet.Contains(options.IP) {
+			return fmt.Errorf("%s is not in the network %s", options.IP, subnet)
+		}
+
+		if err := checkAddressUnused(conn, options.Name, options.IP); err != nil {
+			return err
+		}
+
+		address = options.IP
+	}
+
+	if options.SetGroups {
+		groups = options.Groups
+	}
+
+	if options.IP == nil && !options.SetGroups && metadataProblem == "" {
+		fmt.Printf("'%s' is not broken, nothing to repair\n", options.Name)
+		return nil
+	}
+
+	if err := setDomainDescription(domain, address, groups); err != nil {
+		return err
+	}
+
+	if metadataProblem != "" {
+		if err := setDomainMetadata(domain, &DomainMetadata{}); err != nil {
+			return err
+		}
+
+		fmt.Println("The metadata was reset, the distro, variables and create options of the VM are lost")
+	}
+
+	fmt.Printf("'%s' now has the address %s and the groups '%s'\n", options.Name, address, strings.Join(groups, ","))
+
+	return nil
+}
+
+func parseRepair(args []string) (*RepairOptions, error) {
+	command := flag.NewFlagSet("repair", flag.ExitOnError)
+	ip := command.String("ip", "", "the address of the VM")
+	groups := command.String("groups", "", "the Ansible groups of the VM, separated with commas")
+
+	command.Parse(args[2:])
+
+	if len(command.Args()) < 1 {
+		return nil, errors.New("repair subcommand requires a name")
+	}
+
+	// Flags after the name are not parsed, they would be ignored without a word
+	if len(command.Args()) > 1 {
+		return nil, fmt.Errorf("repair subcommand takes one name, the flags go before it: %s", strings.Join(command.Args()[1:], " "))
+	}
+
+	options := &RepairOptions{Name: command.Args()[0]}
+
+	command.Visit(func(f *flag.Flag) {
+		if f.Name == "groups" {
+			options.SetGroups = true
+		}
+	})
+
+	var err error
+
+	if *ip != "" {
+		options.IP = net.ParseIP(*ip).To4()
+		if options.IP == nil {
+			return nil, fmt.Errorf("'%s' is not an IPv4 address", *ip)
+		}
+	}
+
+	options.Groups, err = parseGroups(*groups)
+	if err != nil {
+		return nil, err
+	}
+
+	return options, nil
+}
+
+// Groups separated with commas. They can't contain a colon since that separates the parts of the description.
+func parseGroups(value string) ([]string, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	groups := strings.Split(value, ",")
+
+	for _, group := range groups {
+		if group == "" || strings.Contains(group, ":") {
+			return nil, fmt.Errorf("'%s' is not a valid group name", group)
+		}
+	}
+
+	return groups, nil
+}
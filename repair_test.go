@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestParseRepair(t *testing.T) {
+	var tests = []struct {
+		args  []string
+		want  *RepairOptions
+		valid bool
+	}{
+		{
+			[]string{"lab-cli", "repair", "--ip", "192.168.100.10", "--groups", "web,db", "lab01"},
+			&RepairOptions{Name: "lab01", IP: net.ParseIP("192.168.100.10").To4(), Groups: []string{"web", "db"}, SetGroups: true},
+			true,
+		},
+		{
+			[]string{"lab-cli", "repair", "--groups", "", "lab01"},
+			&RepairOptions{Name: "lab01", SetGroups: true},
+			true,
+		},
+		{[]string{"lab-cli", "repair", "lab01"}, &RepairOptions{Name: "lab01"}, true},
+		{[]string{"lab-cli", "repair", "--ip", "lab", "lab01"}, nil, false},
+		{[]string{"lab-cli", "repair", "--groups", "web:db", "lab01"}, nil, false},
+		{[]string{"lab-cli", "repair", "--groups", "web,,db", "lab01"}, nil, false},
+		{[]string{"lab-cli", "repair"}, nil, false},
+		{[]string{"lab-cli", "repair", "lab01", "--ip", "192.168.100.10"}, nil, false},
+	}
+
+	for _, test := range tests {
+		options, err := parseRepair(test.args)
+		if (err == nil) != test.valid {
+			t.Errorf("unexpected result for %v: %v", test.args, err)
+			continue
+		}
+
+		if test.valid && !reflect.DeepEqual(options, test.want) {
+			t.Errorf("got %+v for %v, want %+v", options, test.args, test.want)
+		}
+	}
+}
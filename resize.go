@@ -0,0 +1,350 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	libvirt "libvirt.org/libvirt-go"
+)
+
+type ResizeOptions struct {
+	Name  string
+	RAM   int
+	VCPUs int
+	Disk  int
+}
+
+// Grows the partition and filesystem that / lives on to fill the disk. It handles both
+// a plain partition (Debian) and a LVM volume (CentOS autopart). sfdisk is used instead of
+// growpart since it is available on a minimal install of both distributions.
+//
+// The Debian atomic recipe puts swap in a logical partition right after /, which leaves
+// no room to grow. The swap partition is removed and created again at the end of the
+// disk with the same UUID, so /etc/fstab still finds it. Any other partition after /
+// is an error, the disk would be resized but / would not grow.
+const growCommands = `set -e
+root=$(findmnt -n -o SOURCE /)
+fstype=$(findmnt -n -o FSTYPE /)
+pv=$root
+if [ -n "$(lvs --noheadings "$root" 2>/dev/null)" ]; then
+    pv=$(lvs --noheadings -o devices "$root" | sed 's/(.*//' | tr -d ' ' | head -n 1)
+fi
+pv=$(readlink -f "$pv")
+disk=/dev/$(lsblk -n -d -o PKNAME "$pv")
+part=$(cat "$sysfs/$(basename "$pv")/partition")
+swap=""
+after=""
+for dev in $(lsblk -n -r -o NAME,TYPE "$disk" | awk '$2 == "part" { print $1 }'); do
+    n=$(cat "$sysfs/$dev/partition")
+    if [ "$n" -le "$part" ]; then
+        continue
+    fi
+    if [ -z "$swap" ] && [ "$(lsblk -n -d -o FSTYPE "/dev/$dev")" = swap ]; then
+        swap=/dev/$dev
+    elif [ "$(cat "$sysfs/$dev/size")" -gt 2 ]; then
+        # Anything larger than the 1 KiB an extended partition shows up as
+        echo "/dev/$dev comes after / on $disk, / has to be grown by hand" >&2
+        exit 1
+    fi
+    after="$n $after"
+done
+if [ -n "$swap" ]; then
+    uuid=$(lsblk -n -d -o UUID "$swap")
+    swapsize=$(cat "$sysfs/$(basename "$swap")/size")
+    swapoff "$swap"
+fi
+for n in $after; do
+    sfdisk --force --no-reread --delete "$disk" "$n" >/dev/null
+    partx -d --nr "$n" "$disk"
+done
+if [ -n "$swap" ]; then
+    start=$(cat "$sysfs/$(basename "$pv")/start")
+    total=$(cat "$sysfs/$(basename "$disk")/size")
+    # Leave room for the swap partition and the alignment of its start
+    echo ", $((total - start - swapsize - 2048))" | sfdisk --force --no-reread -N "$part" "$disk" >/dev/null
+else
+    echo ", +" | sfdisk --force --no-reread -N "$part" "$disk" >/dev/null
+fi
+partx -u --nr "$part" "$disk"
+if [ -n "$swap" ]; then
+    echo ", , S" | sfdisk --force --no-reread --append "$disk" >/dev/null
+    swap=$(sfdisk --dump "$disk" | grep '^/dev/' | tail -n 1 | cut -d ' ' -f 1)
+    partx -a --nr "$(echo "$swap" | sed 's/.*[^0-9]//')" "$disk"
+    mkswap ${uuid:+-U "$uuid"} "$swap" >/dev/null
+    swapon "$swap"
+fi
+if [ "$pv" != "$(readlink -f "$root")" ]; then
+    pvresize "$pv"
+    lvextend -l +100%FREE "$root" || true
+fi
+case "$fstype" in
+    xfs) xfs_growfs / ;;
+    ext*) resize2fs "$root" ;;
+    *) echo "unsupported filesystem $fstype" >&2; exit 1 ;;
+esac
+`
+
+// The script for the guest, sysfs is only changed by the tests
+func growScript(sysfs string) string {
+	return "sysfs=" + sysfs + "\n" + growCommands
+}
+
+func resizeCommand(args []string, config *Config) error {
+	// Parse arguments
+	options, err := parseResize(args)
+	if err != nil {
+		return err
+	}
+
+	// Create a libvirt connection
+	conn, err := libvirt.NewConnect("qemu:///system")
+	if err != nil {
+		return err
+	}
+
+	domain, err := getExistingDomain(conn, options.Name)
+	if err != nil {
+		return err
+	}
+
+	active, err := domain.IsActive()
+	if err != nil {
+		return err
+	}
+
+	// Changes that could only be written to the persistent configuration
+	var pending []string
+
+	if options.RAM > 0 {
+		live, err := resizeMemory(domain, uint64(options.RAM)*1024, active)
+		if err != nil {
+			return err
+		}
+
+		if active && !live {
+			pending = append(pending, "RAM")
+		}
+
+		fmt.Printf("RAM set to %d MiB\n", options.RAM)
+	}
+
+	if options.VCPUs > 0 {
+		live, err := resizeVcpus(domain, uint(options.VCPUs), active)
+		if err != nil {
+			return err
+		}
+
+		if active && !live {
+			pending = append(pending, "VCPUs")
+		}
+
+		fmt.Printf("VCPUs set to %d\n", options.VCPUs)
+	}
+
+	if options.Disk > 0 {
+		err := resizeDisk(conn, domain, uint64(options.Disk)*1024*1024*1024, active)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Disk set to %d GB\n", options.Disk)
+
+		if active {
+			// Grow the partition and filesystem from inside the guest
+			summary, err := getDomainSummary(domain)
+			if err != nil {
+				return err
+			}
+
+			if err := summary.Err(); err != nil {
+				return fmt.Errorf("the disk was resized but the filesystem can't be grown: %s", err)
+			}
+
+			arguments := append(sshArguments(config, summary.Address), "sudo", "sh", "-s")
+
+			cmd := exec.Command("/usr/bin/ssh", arguments...)
+			cmd.Stdin = strings.NewReader(growScript("/sys/class/block"))
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = os.Stderr
+
+			if err := cmd.Run(); err != nil {
+				return fmt.Errorf("the disk was resized but growing the filesystem failed: %s", err)
+			}
+		} else {
+			fmt.Printf("\nThe filesystem has not been grown since '%s' is not running. Start it and run the same resize command again.\n", options.Name)
+		}
+	}
+
+	if len(pending) > 0 {
+		fmt.Printf("\n'%s' needs to be restarted before the new %s settings take effect.\n", options.Name, strings.Join(pending, " and "))
+	}
+
+	return nil
+}
+
+// Set the memory of the domain in KiB. The persistent configuration is always updated
+// and the maximum memory is raised if needed. Returns true if the change could also be
+// applied to the running domain.
+func resizeMemory(domain *libvirt.Domain, memory uint64, active bool) (bool, error) {
+	type DomainXML struct {
+		Memory uint64 `xml:"memory"`
+	}
+
+	xmlDesc, err := domain.GetXMLDesc(libvirt.DOMAIN_XML_INACTIVE)
+	if err != nil {
+		return false, err
+	}
+
+	var parsedDomain DomainXML
+	if err := xml.Unmarshal([]byte(xmlDesc), &parsedDomain); err != nil {
+		return false, err
+	}
+
+	// The current memory can not be set higher than the maximum memory
+	if memory > parsedDomain.Memory {
+		err := domain.SetMemoryFlags(memory, libvirt.DOMAIN_MEM_CONFIG|libvirt.DOMAIN_MEM_MAXIMUM)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	err = domain.SetMemoryFlags(memory, libvirt.DOMAIN_MEM_CONFIG)
+	if err != nil {
+		return false, err
+	}
+
+	if !active {
+		return false, nil
+	}
+
+	// The balloon driver can only change memory up to the maximum the domain was started with
+	maxMemory, err := domain.GetMaxMemory()
+	if err != nil {
+		return false, err
+	}
+
+	if memory > maxMemory {
+		return false, nil
+	}
+
+	if err := domain.SetMemoryFlags(memory, libvirt.DOMAIN_MEM_LIVE); err != nil {
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// Set the number of VCPUs for the domain. Works the same way as resizeMemory.
+func resizeVcpus(domain *libvirt.Domain, vcpus uint, active bool) (bool, error) {
+	maxVcpus, err := domain.GetVcpusFlags(libvirt.DOMAIN_VCPU_CONFIG | libvirt.DOMAIN_VCPU_MAXIMUM)
+	if err != nil {
+		return false, err
+	}
+
+	if vcpus > uint(maxVcpus) {
+		err := domain.SetVcpusFlags(vcpus, libvirt.DOMAIN_VCPU_CONFIG|libvirt.DOMAIN_VCPU_MAXIMUM)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	err = domain.SetVcpusFlags(vcpus, libvirt.DOMAIN_VCPU_CONFIG)
+	if err != nil {
+		return false, err
+	}
+
+	if !active {
+		return false, nil
+	}
+
+	maxVcpus, err = domain.GetVcpusFlags(libvirt.DOMAIN_VCPU_LIVE | libvirt.DOMAIN_VCPU_MAXIMUM)
+	if err != nil {
+		return false, err
+	}
+
+	if vcpus > uint(maxVcpus) {
+		return false, nil
+	}
+
+	// Hotplug can fail depending on the guest, the config change is still there
+	if err := domain.SetVcpusFlags(vcpus, libvirt.DOMAIN_VCPU_LIVE); err != nil {
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// Grow the first disk of the domain to size bytes. A running domain has the volume open
+// so it has to be resized through the domain instead, which also lets the guest see the change.
+func resizeDisk(conn *libvirt.Connect, domain *libvirt.Domain, size uint64, active bool) error {
+	disks, err := getDomainDisks(domain)
+	if err != nil {
+		return err
+	}
+
+	if len(disks) < 1 {
+		return errors.New("could not find a disk to resize")
+	}
+
+	disk := disks[0]
+
+	volume, err := conn.LookupStorageVolByPath(disk.Source.File)
+	if err != nil {
+		return err
+	}
+
+	info, err := volume.GetInfo()
+	if err != nil {
+		return err
+	}
+
+	if size < info.Capacity {
+		return errors.New("shrinking a disk is not supported")
+	}
+
+	// Nothing to do, but the filesystem might still need to grow
+	if size == info.Capacity {
+		return nil
+	}
+
+	if active {
+		return domain.BlockResize(disk.Target.Dev, size, libvirt.DOMAIN_BLOCK_RESIZE_BYTES)
+	}
+
+	return volume.Resize(size, 0)
+}
+
+func parseResize(args []string) (*ResizeOptions, error) {
+	command := flag.NewFlagSet("resize", flag.ExitOnError)
+	ram := command.Int("ram", 0, "new amount of RAM in MiB")
+	vcpus := command.Int("vcpus", 0, "new number of VCPUs")
+	disk := command.Int("disk", 0, "new disk size in GB")
+
+	command.Parse(args[2:])
+
+	if len(command.Args()) < 1 {
+		return nil, errors.New("resize subcommand requires a name")
+	}
+
+	if *ram < 0 || *vcpus < 0 || *disk < 0 {
+		return nil, errors.New("sizes can not be negative")
+	}
+
+	if *ram == 0 && *vcpus == 0 && *disk == 0 {
+		return nil, errors.New("resize subcommand requires at least one of --ram, --vcpus or --disk")
+	}
+
+	options := &ResizeOptions{
+		Name:  command.Args()[0],
+		RAM:   *ram,
+		VCPUs: *vcpus,
+		Disk:  *disk,
+	}
+
+	return options, nil
+}
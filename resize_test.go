@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestParseResize(t *testing.T) {
+	options, err := parseResize([]string{"lab-cli", "resize", "--ram", "4096", "--disk", "20", "lab01"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if options.Name != "lab01" || options.RAM != 4096 || options.VCPUs != 0 || options.Disk != 20 {
+		t.Errorf("did not get the options we wanted. got: %+v", options)
+	}
+
+	// At least one size is required
+	if _, err := parseResize([]string{"lab-cli", "resize", "lab01"}); err == nil {
+		t.Errorf("expected an error when no size was given")
+	}
+}
+
+// Run the grow script against a fake sysfs and stubs for the disk tools, which log how
+// they were called. lsblk answers from a table of arguments.
+func runGrowScript(t *testing.T, partitions map[string][2]string, lsblk map[string]string) (string, error) {
+	dir := t.TempDir()
+	sysfs := path.Join(dir, "sys")
+	bin := path.Join(dir, "bin")
+	logFile := path.Join(dir, "log")
+
+	for name, values := range partitions {
+		os.MkdirAll(path.Join(sysfs, name), 0755)
+		os.WriteFile(path.Join(sysfs, name, "size"), []byte(values[0]+"\n"), 0644)
+
+		if values[1] != "" {
+			os.WriteFile(path.Join(sysfs, name, "partition"), []byte(values[1]+"\n"), 0644)
+		}
+	}
+
+	os.WriteFile(path.Join(sysfs, "vda1", "start"), []byte("2048\n"), 0644)
+	os.MkdirAll(bin, 0755)
+
+	var answers strings.Builder
+	for args, answer := range lsblk {
+		fmt.Fprintf(&answers, "%q) printf %q ;;\n", args, answer)
+	}
+
+	stubs := map[string]string{
+		"findmnt": `case "$*" in *SOURCE*) echo /dev/vda1 ;; *) echo ext4 ;; esac`,
+		"lvs":     `exit 5`,
+		"lsblk":   "case \"$*\" in\n" + answers.String() + "esac",
+		"sfdisk": `case "$*" in
+*--dump*) printf '/dev/vda1 : start=2048, type=83\n/dev/vda2 : start=39940096, type=82\n' ;;
+*-N*|*--append*) echo "sfdisk $* < $(cat)" >> "$LOG" ;;
+*) echo "sfdisk $*" >> "$LOG" ;;
+esac`,
+	}
+
+	for _, name := range []string{"partx", "swapoff", "swapon", "mkswap", "resize2fs", "pvresize", "lvextend", "xfs_growfs"} {
+		stubs[name] = `echo "$(basename "$0") $*" >> "$LOG"`
+	}
+
+	for name, script := range stubs {
+		os.WriteFile(path.Join(bin, name), []byte("#!/bin/sh\n"+script+"\n"), 0755)
+	}
+
+	cmd := exec.Command("sh", "-c", growScript(sysfs))
+	cmd.Env = append(os.Environ(), "PATH="+bin+":"+os.Getenv("PATH"), "LOG="+logFile)
+
+	output, err := cmd.CombinedOutput()
+	log, _ := os.ReadFile(logFile)
+
+	return string(log) + string(output), err
+}
+
+func TestGrowScript(t *testing.T) {
+	// The Debian atomic recipe on a disk that was grown from 10 to 20 GB
+	partitions := map[string][2]string{
+		"vda":  {"41943040", ""},
+		"vda1": {"18970624", "1"},
+		"vda2": {"2", "2"},
+		"vda5": {"2000000", "5"},
+	}
+
+	lsblk := map[string]string{
+		"-n -d -o PKNAME /dev/vda1":   "vda\n",
+		"-n -r -o NAME,TYPE /dev/vda": "vda disk\nvda1 part\nvda2 part\nvda5 part\n",
+		"-n -d -o FSTYPE /dev/vda2":   "\n",
+		"-n -d -o FSTYPE /dev/vda5":   "swap\n",
+		"-n -d -o UUID /dev/vda5":     "0b3c-swap\n",
+	}
+
+	log, err := runGrowScript(t, partitions, lsblk)
+	if err != nil {
+		t.Fatalf("the script failed: %s\n%s", err, log)
+	}
+
+	want := `swapoff /dev/vda5
+sfdisk --force --no-reread --delete /dev/vda 5
+partx -d --nr 5 /dev/vda
+sfdisk --force --no-reread --delete /dev/vda 2
+partx -d --nr 2 /dev/vda
+sfdisk --force --no-reread -N 1 /dev/vda < , 39938944
+partx -u --nr 1 /dev/vda
+sfdisk --force --no-reread --append /dev/vda < , , S
+partx -a --nr 2 /dev/vda
+mkswap -U 0b3c-swap /dev/vda2
+swapon /dev/vda2
+resize2fs /dev/vda1
+`
+	if log != want {
+		t.Errorf("got:\n%s\nwant:\n%s", log, want)
+	}
+
+	// A data partition after / can't be moved
+	partitions["vda2"] = [2]string{"4000000", "2"}
+	delete(partitions, "vda5")
+	lsblk["-n -r -o NAME,TYPE /dev/vda"] = "vda disk\nvda1 part\nvda2 part\n"
+	lsblk["-n -d -o FSTYPE /dev/vda2"] = "ext4\n"
+
+	log, err = runGrowScript(t, partitions, lsblk)
+	if err == nil || !strings.Contains(log, "/dev/vda2 comes after /") || strings.Contains(log, "sfdisk") {
+		t.Errorf("expected the script to stop before changing anything:\n%s", log)
+	}
+
+	// / on the last partition is simply grown
+	delete(partitions, "vda2")
+	lsblk["-n -r -o NAME,TYPE /dev/vda"] = "vda disk\nvda1 part\n"
+
+	log, err = runGrowScript(t, partitions, lsblk)
+	if err != nil {
+		t.Fatalf("the script failed: %s\n%s", err, log)
+	}
+
+	want = "sfdisk --force --no-reread -N 1 /dev/vda < , +\npartx -u --nr 1 /dev/vda\nresize2fs /dev/vda1\n"
+	if log != want {
+		t.Errorf("got:\n%s\nwant:\n%s", log, want)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	libvirt "libvirt.org/libvirt-go"
+)
+
+var errInterrupted = errors.New("interrupted")
+
+// Returned by an undo function when the resource was never created, so it is left out of the report
+var errNothingToUndo = errors.New("nothing to undo")
+
+// Resources that a command like create has allocated so far, undone in reverse order
+// if the VM can't be created. Ctrl+C and SIGTERM are caught until the rollback is committed.
+type rollback struct {
+	command string
+	steps   []rollbackStep
+	signals chan os.Signal
+}
+
+type rollbackStep struct {
+	description string
+	undo        func() error
+}
+
+// The command is only used in the report of Fail
+func newRollback(command string) *rollback {
+	r := &rollback{command: command, signals: make(chan os.Signal, 1)}
+	signal.Notify(r.signals, syscall.SIGINT, syscall.SIGTERM)
+
+	return r
+}
+
+// Record a resource, description says what undo does (like "remove the VM")
+func (r *rollback) Add(description string, undo func() error) {
+	r.steps = append(r.steps, rollbackStep{description: description, undo: undo})
+}
+
+// The VM has been created, keep everything and stop catching signals
+func (r *rollback) Commit() {
+	signal.Stop(r.signals)
+	r.steps = nil
+}
+
+// Stop catching signals, for the ways out of create that leave nothing behind
+func (r *rollback) Close() {
+	signal.Stop(r.signals)
+}
+
+// Whether a signal has arrived since the rollback was started
+func (r *rollback) Interrupted() bool {
+	select {
+	case <-r.signals:
+		return true
+	default:
+		return false
+	}
+}
+
+// Undo everything and return err together with what was cleaned up
+func (r *rollback) Fail(err error) error {
+	signal.Stop(r.signals)
+
+	report := r.run()
+	if len(report) == 0 {
+		return err
+	}
+
+	return fmt.Errorf("%s\nCleaned up after the failed %s:\n  %s", err, r.command, strings.Join(report, "\n  "))
+}
+
+func (r *rollback) run() []string {
+	var report []string
+
+	for i := len(r.steps) - 1; i >= 0; i-- {
+		step := r.steps[i]
+
+		err := step.undo()
+		if err == errNothingToUndo {
+			continue
+		}
+
+		if err != nil {
+			report = append(report, fmt.Sprintf("failed: %s: %s", step.description, err))
+		} else {
+			report = append(report, "done: "+step.description)
+		}
+	}
+
+	r.steps = nil
+
+	return report
+}
+
+// Run a command, or stop it if create is interrupted
+func (r *rollback) Run(cmd *exec.Cmd) ([]byte, error) {
+	var output strings.Builder
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		return []byte(output.String()), err
+	case <-r.signals:
+		// Ctrl+C already reaches the command through the terminal, make sure it stops on SIGTERM as well
+		cmd.Process.Signal(syscall.SIGTERM)
+		<-done
+
+		return []byte(output.String()), errInterrupted
+	}
+}
+
+// Remove a domain that virt-install or virt-clone defined. Nothing is done if it was never
+// defined, the address it reserved in its description is released with it. The disks are
+// left alone, some of them can be volumes that existed before. The volumes that were
+// created for the domain have steps of their own.
+func undoDomain(conn *libvirt.Connect, name string) error {
+	domain, err := getDomain(conn, name)
+	if err != nil {
+		if strings.Contains(err.Error(), "Domain not found") {
+			return errNothingToUndo
+		}
+
+		return err
+	}
+	defer domain.Free()
+
+	active, err := domain.IsActive()
+	if err != nil {
+		return err
+	}
+
+	if active {
+		if err := domain.DestroyFlags(libvirt.DOMAIN_DESTROY_DEFAULT); err != nil {
+			return err
+		}
+	}
+
+	return domain.UndefineFlags(libvirt.DOMAIN_UNDEFINE_NVRAM | libvirt.DOMAIN_UNDEFINE_MANAGED_SAVE |
+		libvirt.DOMAIN_UNDEFINE_SNAPSHOTS_METADATA)
+}
+
+// Delete volumes that were created for a domain, after the domain is gone or if it was never defined
+func undoVolumes(conn *libvirt.Connect, files []string) error {
+	deleted := false
+
+	for _, file := range files {
+		volume, err := conn.LookupStorageVolByPath(file)
+		if err != nil {
+			if strings.Contains(err.Error(), "Storage volume not found") {
+				continue
+			}
+
+			return err
+		}
+
+		err = volume.Delete(libvirt.STORAGE_VOL_DELETE_NORMAL)
+		volume.Free()
+
+		if err != nil {
+			return err
+		}
+
+		deleted = true
+	}
+
+	if !deleted {
+		return errNothingToUndo
+	}
+
+	return nil
+}
+
+// Stop and remove a network that create defined
+func removeNetwork(network *libvirt.Network) error {
+	active, err := network.IsActive()
+	if err != nil {
+		return err
+	}
+
+	if active {
+		if err := network.Destroy(); err != nil {
+			return err
+		}
+	}
+
+	return network.Undefine()
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRollbackFail(t *testing.T) {
+	tx := newRollback("create")
+	defer tx.Close()
+
+	var order []string
+
+	tx.Add("stop the network", func() error {
+		order = append(order, "network")
+		return nil
+	})
+	tx.Add("delete the volumes", func() error {
+		order = append(order, "volumes")
+		return errNothingToUndo
+	})
+	tx.Add("remove the VM", func() error {
+		order = append(order, "domain")
+		return errors.New("permission denied")
+	})
+
+	err := tx.Fail(errors.New("virt-install failed"))
+
+	want := []string{"domain", "volumes", "network"}
+	if !reflect.DeepEqual(order, want) {
+		t.Errorf("the steps were undone in the wrong order. got: %v, want: %v", order, want)
+	}
+
+	message := err.Error()
+	for _, line := range []string{"virt-install failed", "after the failed create:", "failed: remove the VM: permission denied", "done: stop the network"} {
+		if !strings.Contains(message, line) {
+			t.Errorf("'%s' is missing in the error:\n%s", line, message)
+		}
+	}
+
+	if strings.Contains(message, "delete the volumes") {
+		t.Errorf("a step with nothing to undo was reported:\n%s", message)
+	}
+}
+
+func TestRollbackCommit(t *testing.T) {
+	tx := newRollback("create")
+	defer tx.Close()
+
+	tx.Add("remove the VM", func() error {
+		t.Error("a committed step was undone")
+		return nil
+	})
+
+	tx.Commit()
+
+	err := errors.New("the installation failed")
+	if got := tx.Fail(err); got != err {
+		t.Errorf("the error should be returned as it is without steps, got: %s", got)
+	}
+}
+
+func TestRollbackRun(t *testing.T) {
+	tx := newRollback("create")
+	defer tx.Close()
+
+	output, err := tx.Run(exec.Command("/bin/sh", "-c", "echo out; echo err >&2; exit 3"))
+	if err == nil {
+		t.Fatal("expected the exit status as an error")
+	}
+
+	if string(output) != "out\nerr\n" {
+		t.Errorf("got the output %q", output)
+	}
+}
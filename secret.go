@@ -0,0 +1,315 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Passwords for a VM, saved in the secrets file
+type Secrets struct {
+	RootPassword    string `toml:"root_password"`
+	AnsiblePassword string `toml:"ansible_password,omitempty"`
+}
+
+const passwordChars = "abcdefghijkmnopqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// Alphabet used by crypt(3) for its base64 encoding
+const cryptChars = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+func secretCommand(args []string) error {
+	if len(args) < 3 || args[2] != "show" {
+		return errors.New("secret subcommand requires an action (show)")
+	}
+
+	if len(args) < 4 {
+		return errors.New("secret show requires a name")
+	}
+
+	name := args[3]
+
+	secrets, err := loadSecrets()
+	if err != nil {
+		return err
+	}
+
+	secret, exists := secrets[name]
+	if !exists {
+		return fmt.Errorf("there are no secrets stored for '%s'", name)
+	}
+
+	fmt.Printf("root: %s\n", secret.RootPassword)
+
+	if secret.AnsiblePassword != "" {
+		fmt.Printf("ansible: %s\n", secret.AnsiblePassword)
+	}
+
+	return nil
+}
+
+// Passwords for a new VM. The root password comes from the config if it is set,
+// otherwise a random one is generated.
+func newSecrets(config *Config) (*Secrets, error) {
+	secrets := &Secrets{RootPassword: config.RootPassword}
+
+	if secrets.RootPassword == "" {
+		password, err := generatePassword(20)
+		if err != nil {
+			return nil, err
+		}
+
+		secrets.RootPassword = password
+	}
+
+	if config.AnsibleConsolePassword {
+		password, err := generatePassword(20)
+		if err != nil {
+			return nil, err
+		}
+
+		secrets.AnsiblePassword = password
+	}
+
+	return secrets, nil
+}
+
+func generatePassword(length int) (string, error) {
+	password := make([]byte, length)
+
+	for i := range password {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(passwordChars))))
+		if err != nil {
+			return "", err
+		}
+
+		password[i] = passwordChars[n.Int64()]
+	}
+
+	return string(password), nil
+}
+
+func getSecretsFile() (string, error) {
+	configDir, err := getConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	return path.Join(configDir, "secrets.toml"), nil
+}
+
+// Load the secrets for all VMs, the key is the VM name
+func loadSecrets() (map[string]Secrets, error) {
+	secrets := make(map[string]Secrets)
+
+	secretsFile, err := getSecretsFile()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := os.Stat(secretsFile); os.IsNotExist(err) {
+		return secrets, nil
+	}
+
+	if _, err := toml.DecodeFile(secretsFile, &secrets); err != nil {
+		return nil, err
+	}
+
+	return secrets, nil
+}
+
+// Save or remove (if secret is nil) the secrets for a VM. The file is only readable by the user.
+func storeSecrets(name string, secret *Secrets) error {
+	secrets, err := loadSecrets()
+	if err != nil {
+		return err
+	}
+
+	if secret != nil {
+		secrets[name] = *secret
+	} else if _, exists := secrets[name]; exists {
+		delete(secrets, name)
+	} else {
+		return nil
+	}
+
+	secretsFile, err := getSecretsFile()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(path.Dir(secretsFile), 0755); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so the old file is intact if something goes wrong
+	f, err := ioutil.TempFile(path.Dir(secretsFile), ".secrets")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := toml.NewEncoder(f).Encode(secrets); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), secretsFile)
+}
+
+// Hash a password with SHA-512 crypt ($6$) using a random salt, the format
+// that both debian-installer and anaconda accept for crypted passwords
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+
+	for i := range salt {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(cryptChars))))
+		if err != nil {
+			return "", err
+		}
+
+		salt[i] = cryptChars[n.Int64()]
+	}
+
+	return sha512Crypt(password, string(salt)), nil
+}
+
+// SHA-512 crypt with the default 5000 rounds, as described in
+// https://www.akkadia.org/drepper/SHA-crypt.txt
+func sha512Crypt(password string, salt string) string {
+	const rounds = 5000
+
+	key := []byte(password)
+
+	if len(salt) > 16 {
+		salt = salt[:16]
+	}
+	saltBytes := []byte(salt)
+
+	// Digest B
+	b := sha512.New()
+	b.Write(key)
+	b.Write(saltBytes)
+	b.Write(key)
+	digestB := b.Sum(nil)
+
+	// Digest A
+	a := sha512.New()
+	a.Write(key)
+	a.Write(saltBytes)
+
+	for i := len(key); i > 0; i -= 64 {
+		if i > 64 {
+			a.Write(digestB)
+		} else {
+			a.Write(digestB[:i])
+		}
+	}
+
+	for i := len(key); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			a.Write(digestB)
+		} else {
+			a.Write(key)
+		}
+	}
+
+	digestA := a.Sum(nil)
+
+	// Sequence P
+	dp := sha512.New()
+	for i := 0; i < len(key); i++ {
+		dp.Write(key)
+	}
+	p := repeatBytes(dp.Sum(nil), len(key))
+
+	// Sequence S
+	ds := sha512.New()
+	for i := 0; i < 16+int(digestA[0]); i++ {
+		ds.Write(saltBytes)
+	}
+	s := repeatBytes(ds.Sum(nil), len(saltBytes))
+
+	digest := digestA
+
+	for i := 0; i < rounds; i++ {
+		c := sha512.New()
+
+		if i&1 != 0 {
+			c.Write(p)
+		} else {
+			c.Write(digest)
+		}
+
+		if i%3 != 0 {
+			c.Write(s)
+		}
+
+		if i%7 != 0 {
+			c.Write(p)
+		}
+
+		if i&1 != 0 {
+			c.Write(digest)
+		} else {
+			c.Write(p)
+		}
+
+		digest = c.Sum(nil)
+	}
+
+	// The bytes are encoded in this order
+	order := [][3]int{
+		{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4}, {47, 5, 26}, {6, 27, 48},
+		{28, 49, 7}, {50, 8, 29}, {9, 30, 51}, {31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13},
+		{56, 14, 35}, {15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19}, {62, 20, 41},
+	}
+
+	var encoded []byte
+
+	encode := func(b2, b1, b0 byte, n int) {
+		w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+		for ; n > 0; n-- {
+			encoded = append(encoded, cryptChars[w&0x3f])
+			w >>= 6
+		}
+	}
+
+	for _, o := range order {
+		encode(digest[o[0]], digest[o[1]], digest[o[2]], 4)
+	}
+	encode(0, 0, digest[63], 2)
+
+	return fmt.Sprintf("$6$%s$%s", salt, encoded)
+}
+
+// Repeat the digest until it is length bytes long
+func repeatBytes(digest []byte, length int) []byte {
+	out := make([]byte, 0, length)
+
+	for len(out) < length {
+		n := length - len(out)
+		if n > len(digest) {
+			n = len(digest)
+		}
+
+		out = append(out, digest[:n]...)
+	}
+
+	return out
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSha512Crypt(t *testing.T) {
+	var tests = []struct {
+		password string
+		salt     string
+		want     string
+	}{
+		// From the SHA-crypt specification
+		{"Hello world!", "saltstring", "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"},
+		{"", "saltstring", "$6$saltstring$kyGrqt6gmjAdtFLPrflEFifSYLCWWq1pyx95SvqinLDy2UHmj0sTF0MSLMwxPFZc3tu5kQckI8fks0zOPda3n1"},
+		// Longer than one digest
+		{"a very long password that is longer than one sha-512 digest of sixty four bytes", "abcdefghijklmnop", "$6$abcdefghijklmnop$2frOW/oMQB2svTGBTBMa2TNWs3pWVyQIkHKBhTlpqmEX9aZe3SA.3mcKAyxRTg7H.aWAWOktDzjFz.Wm18XHe."},
+		// Only the first 16 characters of the salt are used
+		{"secret", "toolongsaltstringxyz", "$6$toolongsaltstrin$YbDr56I3YnFMzFdiKjmvZJQFadx22PE13HAFEyCcNt7LQj3KY3OctF6ymrQHwjCUk.FcwaWOEAV7s6i0EMV4i0"},
+	}
+
+	for _, test := range tests {
+		if got := sha512Crypt(test.password, test.salt); got != test.want {
+			t.Errorf("did not get the hash we wanted. got: %s, want: %s", got, test.want)
+		}
+	}
+}
+
+func TestGeneratePassword(t *testing.T) {
+	password, err := generatePassword(20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(password) != 20 {
+		t.Errorf("the password should be 20 characters long, got %d", len(password))
+	}
+
+	for _, c := range password {
+		if !strings.ContainsRune(passwordChars, c) {
+			t.Errorf("the password contains the character %q", c)
+		}
+	}
+}
+
+func TestStoreSecrets(t *testing.T) {
+	os.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	defer os.Unsetenv("XDG_CONFIG_HOME")
+
+	err := storeSecrets("test", &Secrets{RootPassword: "root", AnsiblePassword: "ansible"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secretsFile, err := getSecretsFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(secretsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("the secrets file should have the permissions 0600, got %#o", info.Mode().Perm())
+	}
+
+	secrets, err := loadSecrets()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if secrets["test"].RootPassword != "root" || secrets["test"].AnsiblePassword != "ansible" {
+		t.Errorf("did not get the secrets we saved, got %+v", secrets["test"])
+	}
+
+	if err := storeSecrets("test", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	secrets, err = loadSecrets()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, exists := secrets["test"]; exists {
+		t.Error("the secrets should have been removed")
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long create --no-wait waits for the installer to fetch the install config
+const configFetchTimeout = 10 * time.Minute
+
+// Serves the install config for one VM to the installer. The files are only
+// available under a random path, and the server stops after all of them have been fetched.
+type configServer struct {
+	server   *http.Server
+	base     string
+	files    map[string]string
+	mutex    sync.Mutex
+	fetched  map[string]bool
+	Fetched  chan struct{}
+	listener net.Listener
+}
+
+// Start serving files (name -> path on disk) on address, port 0 picks a free port
+func startConfigServer(address net.IP, port int, files map[string]string) (*configServer, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+
+	// Only listen on the lab network, the configs contain password hashes
+	listener, err := net.Listen("tcp", net.JoinHostPort(address.String(), strconv.Itoa(port)))
+	if err != nil {
+		return nil, fmt.Errorf("could not start the install config server: %s", err)
+	}
+
+	s := &configServer{
+		base:     "/" + hex.EncodeToString(token) + "/",
+		files:    files,
+		fetched:  make(map[string]bool),
+		Fetched:  make(chan struct{}),
+		listener: listener,
+	}
+
+	s.server = &http.Server{Handler: s}
+
+	go s.server.Serve(listener)
+
+	return s, nil
+}
+
+func (s *configServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !strings.HasPrefix(r.URL.Path, s.base) {
+		http.NotFound(w, r)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, s.base)
+
+	file, exists := s.files[name]
+	if !exists {
+		http.NotFound(w, r)
+		return
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(data)
+
+	if r.Method != http.MethodGet {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.fetched) == len(s.files) {
+		return
+	}
+
+	s.fetched[name] = true
+
+	if len(s.fetched) == len(s.files) {
+		close(s.Fetched)
+
+		// Shutdown waits for this request to finish
+		go s.server.Shutdown(context.Background())
+	}
+}
+
+// URL of the directory with the files, ends with a slash
+func (s *configServer) URL() string {
+	return fmt.Sprintf("http://%s%s", s.listener.Addr(), s.base)
+}
+
+func (s *configServer) Close() error {
+	return s.server.Close()
+}
+
+// Kernel arguments that make the installer configure the network and fetch its
+// config from url, since the network has no DHCP.
+func serveKernelArgs(config *Config, options *CreateOptions, address net.IP, url string) string {
+	install, _ := installSettings(config, options)
+	network := config.Network
+
+	switch options.Distro {
+	case "centos":
+		args := []string{
+			"inst.ks=" + url + templateOutName(options.Distro),
+			fmt.Sprintf("ip=%s::%s:%s:%s.%s::none", address, network.Address, network.Netmask, options.Name, network.Domain),
+		}
+
+		for _, nameserver := range install.Nameservers {
+			args = append(args, "nameserver="+nameserver)
+		}
+
+		return strings.Join(args, " ")
+	case "ubuntu":
+		// NoCloud adds user-data and meta-data to the URL itself
+		return strings.Join([]string{
+			"autoinstall",
+			"ds=nocloud-net;s=" + url,
+			fmt.Sprintf("ip=%s::%s:%s:%s::none", address, network.Address, network.Netmask, options.Name),
+		}, " ")
+	}
+
+	// The name servers can't contain spaces on the kernel command line, the
+	// installed system gets all of them from the preseed file
+	return strings.Join([]string{
+		"auto",
+		"url=" + url + templateOutName(options.Distro),
+		"netcfg/choose_interface=auto",
+		"netcfg/disable_autoconfig=true",
+		"netcfg/get_ipaddress=" + address.String(),
+		"netcfg/get_netmask=" + network.Netmask.String(),
+		"netcfg/get_gateway=" + network.Address.String(),
+		"netcfg/get_nameservers=" + install.Nameservers[0],
+		"netcfg/confirm_static=true",
+		"hostname=" + options.Name,
+		"domain=" + network.Domain,
+	}, " ")
+}
+
+// Files for the install config server, the name in the URL mapped to the file
+func serveFiles(outFile string, metaFile string) (map[string]string, error) {
+	files := map[string]string{path.Base(outFile): outFile}
+
+	// NoCloud fetches vendor-data after user-data, the server should still be running then
+	if metaFile != "" {
+		vendorFile := path.Join(path.Dir(metaFile), "vendor-data")
+		if err := os.WriteFile(vendorFile, nil, 0644); err != nil {
+			return nil, err
+		}
+
+		files[path.Base(metaFile)] = metaFile
+		files[path.Base(vendorFile)] = vendorFile
+	}
+
+	return files, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigServer(t *testing.T) {
+	outFile := path.Join(t.TempDir(), "kickstart.cfg")
+	if err := os.WriteFile(outFile, []byte("rootpw --iscrypted x\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := serveFiles(outFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := startConfigServer(net.ParseIP("127.0.0.1"), 0, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	// Files are only served under the random path
+	resp, err := http.Get(strings.Replace(server.URL(), server.base, "/", 1) + "kickstart.cfg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 without the random path, got %d", resp.StatusCode)
+	}
+
+	resp, err = http.Get(server.URL() + "kickstart.cfg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if string(body) != "rootpw --iscrypted x\n" {
+		t.Errorf("did not get the file we wanted. got: %s", body)
+	}
+
+	select {
+	case <-server.Fetched:
+	case <-time.After(5 * time.Second):
+		t.Error("the server should be done after all files have been fetched")
+	}
+}
+
+func TestServeKernelArgs(t *testing.T) {
+	config := defaultConfig
+	options := &CreateOptions{Name: "lab01", Distro: "centos"}
+
+	args := serveKernelArgs(&config, options, net.ParseIP("192.168.100.10"), "http://192.168.100.1:8080/abc/")
+	want := "inst.ks=http://192.168.100.1:8080/abc/kickstart.cfg ip=192.168.100.10::192.168.100.1:255.255.255.0:lab01.lab.local::none nameserver=192.168.100.1"
+
+	if args != want {
+		t.Errorf("did not get the kernel arguments we wanted. got: %s, want: %s", args, want)
+	}
+}
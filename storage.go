@@ -0,0 +1,381 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	libvirt "libvirt.org/libvirt-go"
+)
+
+// Storage pool that virt-install puts the disks in, unless storage_pool is set in the config
+const defaultStoragePool = "default"
+
+var diskFormats = []string{"qcow2", "raw"}
+
+var diskBuses = []string{"virtio", "scsi", "sata", "ide"}
+
+// Only characters that are safe in a file name and a disk serial number
+var diskName = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// Data disk in addition to the system disk, the name is used for the
+// volume and as the serial number so it can be found in /dev/disk/by-id
+type ExtraDisk struct {
+	Name string `xml:"name,attr"`
+	Size int    `xml:"size,attr"`
+	// An existing volume to attach instead of creating one, set by rebuild
+	Path string `xml:"-"`
+}
+
+// Parse an extra disk given as size=20,name=data
+func parseExtraDisk(value string) (ExtraDisk, error) {
+	var disk ExtraDisk
+
+	for _, option := range strings.Split(value, ",") {
+		parts := strings.SplitN(option, "=", 2)
+		if len(parts) != 2 {
+			return disk, fmt.Errorf("'%s' in the extra disk '%s' is not key=value", option, value)
+		}
+
+		switch parts[0] {
+		case "size":
+			size, err := strconv.Atoi(parts[1])
+			if err != nil || size <= 0 {
+				return disk, fmt.Errorf("the extra disk size '%s' is not a positive number", parts[1])
+			}
+
+			disk.Size = size
+		case "name":
+			if !diskName.MatchString(parts[1]) {
+				return disk, fmt.Errorf("the extra disk name '%s' can only contain letters, digits, - and _", parts[1])
+			}
+
+			disk.Name = parts[1]
+		default:
+			return disk, fmt.Errorf("'%s' is not an extra disk option, use size and name", parts[0])
+		}
+	}
+
+	if disk.Size == 0 {
+		return disk, fmt.Errorf("the extra disk '%s' needs a size", value)
+	}
+
+	return disk, nil
+}
+
+// A disk of a new VM. create makes the volume itself so it knows which volumes are new,
+// Path is set for the ones that exist already and the ones it has made.
+type diskVolume struct {
+	Name   string
+	Size   int
+	Format string
+	Serial string
+	Path   string
+}
+
+// The volumes for the system disk and the extra disks. The system disk is named after
+// the VM with an extension for the format, the extra disks have their name added.
+func diskVolumes(options *CreateOptions) []diskVolume {
+	format := options.DiskFormat
+	if format == "" {
+		format = "qcow2"
+	}
+
+	extension := format
+	if format == "raw" {
+		extension = "img"
+	}
+
+	volumes := []diskVolume{{Name: fmt.Sprintf("%s.%s", options.Name, extension), Size: options.Disk, Format: format}}
+
+	for _, disk := range options.ExtraDisks {
+		if disk.Path != "" {
+			volumes = append(volumes, diskVolume{Serial: disk.Name, Path: disk.Path})
+			continue
+		}
+
+		format := options.DiskFormat
+		extension := format
+		if format == "" {
+			format = "raw"
+			extension = "img"
+		}
+
+		volumes = append(volumes, diskVolume{
+			Name:   fmt.Sprintf("%s-%s.%s", options.Name, disk.Name, extension),
+			Size:   disk.Size,
+			Format: format,
+			Serial: disk.Name,
+		})
+	}
+
+	return volumes
+}
+
+// Volume XML for a disk, sparse like the ones virt-install creates
+func diskVolumeXML(volume diskVolume) VolumeXML {
+	data := VolumeXML{Name: volume.Name}
+	data.Capacity.Unit = "bytes"
+	data.Capacity.Value = int64(volume.Size) * 1024 * 1024 * 1024
+	data.Allocation = new(int64)
+	data.Target.Format.Type = volume.Format
+
+	return data
+}
+
+// Create the volume for a disk and return its path. An extra disk that is already in the
+// pool is used as it is, created tells the two apart. The system disk must be new.
+func createDiskVolume(pool *libvirt.StoragePool, volume diskVolume) (file string, created bool, err error) {
+	existing, err := pool.LookupStorageVolByName(volume.Name)
+	if err == nil {
+		defer existing.Free()
+
+		if volume.Serial == "" {
+			return "", false, fmt.Errorf("the volume %s is already in the storage pool", volume.Name)
+		}
+
+		file, err := existing.GetPath()
+		return file, false, err
+	}
+
+	if !strings.Contains(err.Error(), "Storage volume not found") {
+		return "", false, err
+	}
+
+	xmlData, err := xml.Marshal(diskVolumeXML(volume))
+	if err != nil {
+		return "", false, err
+	}
+
+	newVolume, err := pool.StorageVolCreateXML(string(xmlData), 0)
+	if err != nil {
+		return "", false, err
+	}
+	defer newVolume.Free()
+
+	file, err = newVolume.GetPath()
+	if err != nil {
+		newVolume.Delete(libvirt.STORAGE_VOL_DELETE_NORMAL)
+		return "", false, err
+	}
+
+	return file, true, nil
+}
+
+// Arguments for virt-install that attach the volumes, they all have a path by now.
+// The format of a volume that existed before is left to virt-install.
+func diskArguments(options *CreateOptions, volumes []diskVolume) []string {
+	bus := ""
+	if options.DiskBus != "" {
+		bus = ",bus=" + options.DiskBus
+	}
+
+	var arguments []string
+
+	for _, volume := range volumes {
+		settings := "path=" + volume.Path
+
+		if volume.Format != "" {
+			settings += ",format=" + volume.Format
+		}
+
+		settings += bus
+
+		if volume.Serial != "" {
+			settings += ",serial=" + volume.Serial
+		}
+
+		arguments = append(arguments, "--disk", settings)
+	}
+
+	return arguments
+}
+
+// Directory of the storage pool
+func getPoolPath(conn *libvirt.Connect, name string) (string, error) {
+	type PoolXML struct {
+		Target struct {
+			Path string `xml:"path"`
+		} `xml:"target"`
+	}
+
+	pool, err := conn.LookupStoragePoolByName(name)
+	if err != nil {
+		return "", err
+	}
+	defer pool.Free()
+
+	xmlDesc, err := pool.GetXMLDesc(0)
+	if err != nil {
+		return "", err
+	}
+
+	var parsedPool PoolXML
+	if err := xml.Unmarshal([]byte(xmlDesc), &parsedPool); err != nil {
+		return "", err
+	}
+
+	return parsedPool.Target.Path, nil
+}
+
+// Delete the volumes of all disks, including the images they are overlays on. A
+// volume that is already gone is skipped with a warning, and an image that another
+// VM also uses is kept, like the disk of a VM that has linked clones.
+func deleteDiskVolumes(conn *libvirt.Connect, disks []DomainDisk) error {
+	used, err := getUsedDiskFiles(conn)
+	if err != nil {
+		return err
+	}
+
+	for _, disk := range disks {
+		files, err := getDiskFiles(conn, disk)
+		if err != nil {
+			return err
+		}
+
+		for _, file := range files {
+			// The domain being removed is still defined and counted once
+			if used[file] > 1 {
+				fmt.Printf("The image %s is used by another VM, keeping it\n", file)
+				continue
+			}
+
+			volume, err := conn.LookupStorageVolByPath(file)
+			if err != nil {
+				if strings.Contains(err.Error(), "Storage volume not found") {
+					fmt.Printf("The volume %s does not exist, skipping it\n", file)
+					continue
+				}
+
+				return err
+			}
+
+			err = volume.Delete(libvirt.STORAGE_VOL_DELETE_NORMAL)
+			volume.Free()
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// The file of a disk followed by its backing chain
+func diskFiles(disk DomainDisk) []string {
+	var files []string
+
+	if disk.Source.File != "" {
+		files = append(files, disk.Source.File)
+	}
+
+	for store := disk.BackingStore; store != nil; store = store.BackingStore {
+		if store.Source.File != "" {
+			files = append(files, store.Source.File)
+		}
+	}
+
+	return files
+}
+
+// The file of a disk followed by its backing chain. libvirt only shows the chain of
+// running domains, so for the others it is found through the storage volumes.
+func getDiskFiles(conn *libvirt.Connect, disk DomainDisk) ([]string, error) {
+	files := diskFiles(disk)
+	if len(files) != 1 {
+		return files, nil
+	}
+
+	for file := files[0]; ; {
+		backing, err := getVolumeBackingFile(conn, file)
+		if err != nil {
+			return nil, err
+		}
+
+		// Stop at a loop as well, an image can't really be its own backing file
+		if backing == "" || isOneOf(backing, files) {
+			return files, nil
+		}
+
+		files = append(files, backing)
+		file = backing
+	}
+}
+
+// The image a volume is an overlay on, empty if it has none or is not in a storage pool
+func getVolumeBackingFile(conn *libvirt.Connect, file string) (string, error) {
+	volume, err := conn.LookupStorageVolByPath(file)
+	if err != nil {
+		if strings.Contains(err.Error(), "Storage volume not found") {
+			return "", nil
+		}
+
+		return "", err
+	}
+	defer volume.Free()
+
+	xmlDesc, err := volume.GetXMLDesc(0)
+	if err != nil {
+		return "", err
+	}
+
+	return volumeBackingFile(xmlDesc)
+}
+
+func volumeBackingFile(xmlDesc string) (string, error) {
+	var parsedVolume VolumeXML
+	if err := xml.Unmarshal([]byte(xmlDesc), &parsedVolume); err != nil {
+		return "", err
+	}
+
+	if parsedVolume.BackingStore == nil {
+		return "", nil
+	}
+
+	return parsedVolume.BackingStore.Path, nil
+}
+
+// How many disks of all domains, not only the ones lab-cli manages, use each file
+func getUsedDiskFiles(conn *libvirt.Connect) (map[string]int, error) {
+	domains, err := conn.ListAllDomains(0)
+	if err != nil {
+		return nil, err
+	}
+
+	used := make(map[string]int)
+
+	for _, domain := range domains {
+		disks, err := getDomainDisks(&domain)
+		domain.Free()
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, disk := range disks {
+			files, err := getDiskFiles(conn, disk)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, file := range files {
+				used[file]++
+			}
+		}
+	}
+
+	return used, nil
+}
+
+func isOneOf(value string, values []string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/xml"
+	"reflect"
+	"testing"
+)
+
+func TestParseExtraDisk(t *testing.T) {
+	var tests = []struct {
+		value string
+		disk  ExtraDisk
+		valid bool
+	}{
+		{"size=20,name=data", ExtraDisk{Name: "data", Size: 20}, true},
+		{"name=osd-1,size=50", ExtraDisk{Name: "osd-1", Size: 50}, true},
+		{"size=10", ExtraDisk{Size: 10}, true},
+		{"name=data", ExtraDisk{}, false},
+		{"size=0", ExtraDisk{}, false},
+		{"size=ten", ExtraDisk{}, false},
+		{"size=10,name=../data", ExtraDisk{}, false},
+		{"size=10,bus=scsi", ExtraDisk{}, false},
+		{"20", ExtraDisk{}, false},
+	}
+
+	for _, test := range tests {
+		disk, err := parseExtraDisk(test.value)
+		if (err == nil) != test.valid {
+			t.Errorf("unexpected result for '%s': %v", test.value, err)
+			continue
+		}
+
+		if test.valid && disk != test.disk {
+			t.Errorf("got %+v for '%s', want %+v", disk, test.value, test.disk)
+		}
+	}
+}
+
+func TestDiskArguments(t *testing.T) {
+	options := &CreateOptions{Name: "lab01", Disk: 10, DiskBus: "scsi"}
+	volumes := []diskVolume{
+		{Name: "lab01.qcow2", Size: 10, Format: "qcow2", Path: "/var/lib/lab/lab01.qcow2"},
+		{Name: "lab01-data.img", Size: 20, Format: "raw", Serial: "data", Path: "/var/lib/lab/lab01-data.img"},
+		{Serial: "logs", Path: "/var/lib/lab/old-logs.qcow2"},
+	}
+
+	want := []string{
+		"--disk", "path=/var/lib/lab/lab01.qcow2,format=qcow2,bus=scsi",
+		"--disk", "path=/var/lib/lab/lab01-data.img,format=raw,bus=scsi,serial=data",
+		"--disk", "path=/var/lib/lab/old-logs.qcow2,bus=scsi,serial=logs",
+	}
+
+	if got := diskArguments(options, volumes); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestDiskVolumes(t *testing.T) {
+	options := &CreateOptions{
+		Name:       "lab01",
+		Disk:       10,
+		ExtraDisks: []ExtraDisk{{Name: "data", Size: 20}, {Name: "logs", Size: 5, Path: "/pool/old-logs.qcow2"}},
+	}
+
+	want := []diskVolume{
+		{Name: "lab01.qcow2", Size: 10, Format: "qcow2"},
+		{Name: "lab01-data.img", Size: 20, Format: "raw", Serial: "data"},
+		{Serial: "logs", Path: "/pool/old-logs.qcow2"},
+	}
+
+	if got := diskVolumes(options); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	options.DiskFormat = "raw"
+	options.ExtraDisks = options.ExtraDisks[:1]
+
+	want = []diskVolume{
+		{Name: "lab01.img", Size: 10, Format: "raw"},
+		{Name: "lab01-data.raw", Size: 20, Format: "raw", Serial: "data"},
+	}
+
+	if got := diskVolumes(options); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestDiskVolumeXML(t *testing.T) {
+	data, err := xml.Marshal(diskVolumeXML(diskVolume{Name: "lab01.qcow2", Size: 10, Format: "qcow2"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `<volume><name>lab01.qcow2</name><capacity unit="bytes">10737418240</capacity><allocation>0</allocation>` +
+		`<target><format type="qcow2"></format></target></volume>`
+	if string(data) != want {
+		t.Errorf("got %s, want %s", data, want)
+	}
+}
+
+func TestVolumeBackingFile(t *testing.T) {
+	overlay := `<volume type="file">
+  <name>web02.qcow2</name>
+  <target>
+    <path>/var/lib/libvirt/images/web02.qcow2</path>
+    <format type="qcow2"/>
+  </target>
+  <backingStore>
+    <path>/var/lib/libvirt/images/web01.qcow2</path>
+    <format type="qcow2"/>
+  </backingStore>
+</volume>`
+
+	file, err := volumeBackingFile(overlay)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := "/var/lib/libvirt/images/web01.qcow2"; file != want {
+		t.Errorf("got %s, want %s", file, want)
+	}
+
+	file, err = volumeBackingFile(`<volume type="file"><name>web01.qcow2</name></volume>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if file != "" {
+		t.Errorf("a volume without a backing store got the backing file %s", file)
+	}
+}